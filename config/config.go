@@ -2,10 +2,14 @@ package config
 
 import (
 	"container/list"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/robfig/config"
 )
@@ -23,26 +27,74 @@ type SMTPMessage struct {
 }
 
 type SmtpConfig struct {
-	Ip4address      net.IP
-	Ip4port         int
-	Domain          string
-	MaxRecipients   int
-	MaxClients      int
-	MaxIdleSeconds  int
-	MaxMessageBytes int
-	PubKey          string
-	PrvKey          string
-	StoreMessages   bool
-	Xclient         bool
-	Debug           bool
-	DebugPath       string
-	SpamRegex       string
+	Ip4address           net.IP
+	Ip4port              int
+	SubmissionIp4address net.IP
+	SubmissionIp4port    int
+	TLSIp4address        net.IP
+	TLSIp4port           int
+	Domain               string
+	MaxRecipients        int
+	MaxClients           int
+	MaxIdleSeconds       int
+	MaxMessageBytes      int
+	PubKey               string
+	PrvKey               string
+	StoreMessages        bool
+	Xclient              bool
+	Debug                bool
+	DebugPath            string
+	SpamRegex            string
+	TrustedNetworks      []*net.IPNet
+	DropUnknown          bool
+	CramMD5              bool
+	QueueWorkers         int
+	QueueInterval        time.Duration
+	QueueRetryMin        time.Duration
+	QueueRetryMax        time.Duration
+	QueueLifetime        time.Duration
+	QueueDelayWarning    time.Duration
+
+	// Outbound TLS mode (none, may, encrypt or verify) by default and by
+	// recipient domain, and the lowest TLS version accepted
+	OutboundTLS           string
+	OutboundTLSPolicy     map[string]string
+	OutboundTLSMinVersion uint16
+
+	// Relay host for all outbound mail, nil to deliver to the mail
+	// exchangers, and routes by recipient domain overriding it
+	Relayhost *Route
+	Routes    map[string]*Route
+
+	// Limits by destination: open connections and messages per minute,
+	// 0 for no limit
+	OutboundMaxConnections int
+	OutboundRate           int
+}
+
+// Route is how outbound mail for a domain leaves: through a relay host, or
+// Direct to the mail exchangers of the domain. TLS is the mode of STARTTLS,
+// or of the certificate check with ImplicitTLS.
+type Route struct {
+	Direct      bool
+	Host        string
+	Port        int
+	ImplicitTLS bool
+	TLS         string
+	Username    string
+	Password    string
 }
 
 type Pop3Config struct {
 	Ip4address     net.IP
 	Ip4port        int
+	TLSIp4address  net.IP
+	TLSIp4port     int
+	PubKey         string
+	PrvKey         string
 	Domain         string
+	DisablePlain   bool
+	CramMD5        bool
 	MaxClients     int
 	MaxIdleSeconds int
 	Debug          bool
@@ -60,10 +112,12 @@ type WebConfig struct {
 }
 
 type DataStoreConfig struct {
-	Storage   string
-	MongoUri  string
-	MongoDb   string
-	MongoColl string
+	Storage     string
+	MongoUri    string
+	MongoDb     string
+	MongoColl   string
+	MaildirPath string
+	BoltPath    string
 }
 
 var (
@@ -150,10 +204,6 @@ func LoadConfig(filename string) error {
 	requireOption(messages, "web", "public.dir")
 	requireOption(messages, "web", "greeting.file")
 	requireOption(messages, "web", "cookie.secret")
-	requireOption(messages, "datastore", "storage")
-	requireOption(messages, "datastore", "mongo.uri")
-	requireOption(messages, "datastore", "mongo.db")
-	requireOption(messages, "datastore", "mongo.coll")
 
 	// Return error if validations failed
 	if messages.Len() > 0 {
@@ -238,6 +288,19 @@ func parseSmtpConfig() error {
 		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
 	}
 
+	// Submission and implicit TLS listeners are optional, port 0 disables them
+	smtpConfig.SubmissionIp4address, smtpConfig.SubmissionIp4port, err = parseListener(section, "submission", smtpConfig.Ip4address)
+
+	if err != nil {
+		return err
+	}
+
+	smtpConfig.TLSIp4address, smtpConfig.TLSIp4port, err = parseListener(section, "tls", smtpConfig.Ip4address)
+
+	if err != nil {
+		return err
+	}
+
 	option = "domain"
 	str, err = Config.String(section, option)
 
@@ -351,9 +414,406 @@ func parseSmtpConfig() error {
 		smtpConfig.SpamRegex = str
 	}
 
+	option = "trusted.networks"
+	str = "127.0.0.0/8"
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	smtpConfig.TrustedNetworks, err = parseNetworks(str)
+
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+
+	option = "unknown.recipients"
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		switch str {
+		case "reject":
+		case "drop":
+			smtpConfig.DropUnknown = true
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+	}
+
+	option = "auth.cram.md5"
+
+	if Config.HasOption(section, option) {
+		flag, err = Config.Bool(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		smtpConfig.CramMD5 = flag
+	}
+
+	option = "queue.workers"
+	smtpConfig.QueueWorkers = 3
+
+	if Config.HasOption(section, option) {
+		smtpConfig.QueueWorkers, err = Config.Int(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		if smtpConfig.QueueWorkers < 1 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, smtpConfig.QueueWorkers)
+		}
+	}
+
+	if smtpConfig.QueueInterval, err = parseDuration(section, "queue.interval", time.Minute); err != nil {
+		return err
+	}
+
+	if smtpConfig.QueueRetryMin, err = parseDuration(section, "queue.retry.min", 5*time.Minute); err != nil {
+		return err
+	}
+
+	if smtpConfig.QueueRetryMax, err = parseDuration(section, "queue.retry.max", 4*time.Hour); err != nil {
+		return err
+	}
+
+	if smtpConfig.QueueLifetime, err = parseDuration(section, "queue.lifetime", 5*24*time.Hour); err != nil {
+		return err
+	}
+
+	// Delay warnings are off unless configured
+	if smtpConfig.QueueDelayWarning, err = parseDuration(section, "queue.delay.warning", 0); err != nil {
+		return err
+	}
+
+	option = "outbound.tls"
+	smtpConfig.OutboundTLS = "may"
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		if !isTLSMode(str) {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+
+		smtpConfig.OutboundTLS = str
+	}
+
+	option = "outbound.tls.policy"
+	smtpConfig.OutboundTLSPolicy = make(map[string]string)
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		smtpConfig.OutboundTLSPolicy, err = parseTLSPolicy(str)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "outbound.tls.min.version"
+	smtpConfig.OutboundTLSMinVersion = tls.VersionTLS12
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		switch str {
+		case "1.0":
+			smtpConfig.OutboundTLSMinVersion = tls.VersionTLS10
+		case "1.1":
+			smtpConfig.OutboundTLSMinVersion = tls.VersionTLS11
+		case "1.2":
+			smtpConfig.OutboundTLSMinVersion = tls.VersionTLS12
+		case "1.3":
+			smtpConfig.OutboundTLSMinVersion = tls.VersionTLS13
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+	}
+
+	option = "relayhost"
+
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		if str != "" {
+			smtpConfig.Relayhost, err = parseRoute(str)
+
+			if err != nil {
+				return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+			}
+		}
+	}
+
+	option = "outbound.max.connections"
+	smtpConfig.OutboundMaxConnections = 10
+
+	if Config.HasOption(section, option) {
+		if smtpConfig.OutboundMaxConnections, err = parseLimit(section, option); err != nil {
+			return err
+		}
+	}
+
+	option = "outbound.rate"
+
+	if Config.HasOption(section, option) {
+		if smtpConfig.OutboundRate, err = parseLimit(section, option); err != nil {
+			return err
+		}
+	}
+
+	// Routes are "route.<domain>" options
+	smtpConfig.Routes = make(map[string]*Route)
+	options, err := Config.Options(section)
+
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]: '%v'", section, err)
+	}
+
+	for _, option := range options {
+		if !strings.HasPrefix(option, "route.") {
+			continue
+		}
+
+		str, err = Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		route, err := parseRoute(str)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		smtpConfig.Routes[strings.ToLower(strings.TrimPrefix(option, "route."))] = route
+	}
+
 	return nil
 }
 
+// parseLimit parses a limit option, a number which is 0 for no limit
+func parseLimit(section string, option string) (int, error) {
+	n, err := Config.Int(section, option)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, n)
+	}
+
+	return n, nil
+}
+
+// parseDuration parses an optional duration option like "90s" or "4h",
+// returning def if it is missing. Options off by default, with a def of 0,
+// can be set to 0 too.
+func parseDuration(section string, option string, def time.Duration) (time.Duration, error) {
+	if !Config.HasOption(section, option) {
+		return def, nil
+	}
+
+	str, err := Config.String(section, option)
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+
+	d, err := time.ParseDuration(str)
+
+	if err != nil || d < 0 || d == 0 && def != 0 {
+		return 0, fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+	}
+
+	return d, nil
+}
+
+// parseListener parses the optional "<prefix>.ip4.address" and
+// "<prefix>.ip4.port" options of an additional listener. The address defaults
+// to def and a missing port is returned as 0.
+func parseListener(section string, prefix string, def net.IP) (net.IP, int, error) {
+	addr := def
+	port := 0
+
+	option := prefix + ".ip4.address"
+
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		ip := net.ParseIP(str)
+
+		if ip == nil || ip.To4() == nil {
+			return nil, 0, fmt.Errorf("Failed to parse [%v]%v: '%v' not IPv4!", section, option, str)
+		}
+
+		addr = ip.To4()
+	}
+
+	option = prefix + ".ip4.port"
+
+	if Config.HasOption(section, option) {
+		var err error
+		port, err = Config.Int(section, option)
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	return addr, port, nil
+}
+
+// parseNetworks parses a comma or space separated list of CIDR networks, a
+// bare IP address is taken as a single host network.
+func parseNetworks(str string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+
+	for _, field := range strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid network %v", field)
+			}
+
+			if ip.To4() != nil {
+				field = field + "/32"
+			} else {
+				field = field + "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(field)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseRoute parses a route, "direct" or a relay host as
+// smtp[s]://[user:password@]host[:port][?tls=mode]. Relay hosts are sent to
+// with STARTTLS on port 25 for smtp and with implicit TLS on port 465 for
+// smtps, the certificate is verified unless another mode is given.
+func parseRoute(str string) (*Route, error) {
+	if str == "direct" {
+		return &Route{Direct: true}, nil
+	}
+
+	// Errors leave out the credentials
+	u, err := url.Parse(str)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid route, not a URL")
+	}
+
+	name := u.Scheme + "://" + u.Host
+	r := &Route{Host: u.Hostname(), TLS: "verify"}
+
+	switch u.Scheme {
+	case "smtp":
+		r.Port = 25
+	case "smtps":
+		r.Port = 465
+		r.ImplicitTLS = true
+	default:
+		return nil, fmt.Errorf("Invalid route %v, expecting smtp:// or smtps://", name)
+	}
+
+	if r.Host == "" {
+		return nil, fmt.Errorf("Invalid route %v, host missing", name)
+	}
+
+	if port := u.Port(); port != "" {
+		if r.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("Invalid route %v, bad port", name)
+		}
+	}
+
+	if mode := u.Query().Get("tls"); mode != "" {
+		// Implicit TLS cannot be turned off, only its certificate check
+		if !isTLSMode(mode) || r.ImplicitTLS && (mode == "none" || mode == "may") {
+			return nil, fmt.Errorf("Invalid route %v, bad TLS mode", name)
+		}
+
+		r.TLS = mode
+	}
+
+	if u.User != nil {
+		r.Username = u.User.Username()
+		r.Password, _ = u.User.Password()
+	}
+
+	return r, nil
+}
+
+// parseTLSPolicy parses a comma separated list of "domain:mode" entries into
+// a map of lower case domain to mode
+func parseTLSPolicy(str string) (map[string]string, error) {
+	policy := make(map[string]string)
+
+	for _, field := range strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == ' ' }) {
+		s := strings.SplitN(field, ":", 2)
+
+		if len(s) != 2 || s[0] == "" || !isTLSMode(s[1]) {
+			return nil, fmt.Errorf("Invalid TLS policy %v", field)
+		}
+
+		policy[strings.ToLower(s[0])] = s[1]
+	}
+
+	return policy, nil
+}
+
+// isTLSMode returns true if mode is a known outbound TLS mode
+func isTLSMode(mode string) bool {
+	switch mode {
+	case "none", "may", "encrypt", "verify":
+		return true
+	}
+
+	return false
+}
+
 // parsePop3Config trying to catch config errors early
 func parsePop3Config() error {
 	pop3Config = new(Pop3Config)
@@ -388,6 +848,41 @@ func parsePop3Config() error {
 		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
 	}
 
+	// Implicit TLS listener is optional, port 0 disables it
+	pop3Config.TLSIp4address, pop3Config.TLSIp4port, err = parseListener(section, "tls", pop3Config.Ip4address)
+
+	if err != nil {
+		return err
+	}
+
+	// Certificate defaults to the one configured for SMTP
+	pop3Config.PubKey = smtpConfig.PubKey
+	pop3Config.PrvKey = smtpConfig.PrvKey
+
+	option = "public.key"
+
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		pop3Config.PubKey = str
+	}
+
+	option = "private.key"
+
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		pop3Config.PrvKey = str
+	}
+
 	option = "domain"
 	str, err = Config.String(section, option)
 
@@ -397,6 +892,30 @@ func parsePop3Config() error {
 
 	pop3Config.Domain = str
 
+	option = "disable.plaintext.auth"
+
+	if Config.HasOption(section, option) {
+		flag, err := Config.Bool(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		pop3Config.DisablePlain = flag
+	}
+
+	option = "auth.cram.md5"
+
+	if Config.HasOption(section, option) {
+		flag, err := Config.Bool(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		pop3Config.CramMD5 = flag
+	}
+
 	option = "max.clients"
 	pop3Config.MaxClients, err = Config.Int(section, option)
 
@@ -530,40 +1049,98 @@ func parseDataStoreConfig() error {
 	section := "datastore"
 
 	option := "storage"
-	str, err := Config.String(section, option)
+	dataStoreConfig.Storage = "memory"
 
-	if err != nil {
-		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		dataStoreConfig.Storage = str
 	}
 
-	dataStoreConfig.Storage = str
+	switch dataStoreConfig.Storage {
+	case "memory":
+	case "mongodb":
+		// MongoDB settings are only needed when it is used
+		for _, option := range []string{"mongo.uri", "mongo.db", "mongo.coll"} {
+			if !Config.HasOption(section, option) {
+				return fmt.Errorf("Config option '%v' is required in section [%v]", option, section)
+			}
+		}
+	case "maildir":
+		if !Config.HasOption(section, "maildir.path") {
+			return fmt.Errorf("Config option '%v' is required in section [%v]", "maildir.path", section)
+		}
+	case "bolt":
+		if !Config.HasOption(section, "bolt.path") {
+			return fmt.Errorf("Config option '%v' is required in section [%v]", "bolt.path", section)
+		}
+	default:
+		return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, dataStoreConfig.Storage)
+	}
 
 	option = "mongo.uri"
-	str, err = Config.String(section, option)
 
-	if err != nil {
-		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
-	}
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
 
-	dataStoreConfig.MongoUri = str
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		dataStoreConfig.MongoUri = str
+	}
 
 	option = "mongo.db"
-	str, err = Config.String(section, option)
 
-	if err != nil {
-		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
-	}
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
 
-	dataStoreConfig.MongoDb = str
+		dataStoreConfig.MongoDb = str
+	}
 
 	option = "mongo.coll"
-	str, err = Config.String(section, option)
 
-	if err != nil {
-		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		dataStoreConfig.MongoColl = str
 	}
 
-	dataStoreConfig.MongoColl = str
+	option = "maildir.path"
+
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		dataStoreConfig.MaildirPath = str
+	}
+
+	option = "bolt.path"
+
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+
+		dataStoreConfig.BoltPath = str
+	}
 
 	return nil
 }
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Alias redirects mail for Address to Targets, local or remote addresses.
+// An Address of "@domain" is the catch-all of the domain, it gets the mail
+// for addresses of the domain without a mailbox or another alias.
+type Alias struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Address   string
+	Targets   []string
+	CreatedAt time.Time
+}
+
+// NewAlias returns an alias of address to targets, the address is kept in
+// lower case and empty targets are left out
+func NewAlias(address string, targets []string) *Alias {
+	a := &Alias{
+		Id:        bson.NewObjectId(),
+		Address:   strings.ToLower(strings.TrimSpace(address)),
+		Targets:   make([]string, 0, len(targets)),
+		CreatedAt: time.Now(),
+	}
+
+	for _, t := range targets {
+		if t = strings.Trim(t, "<> \t"); t != "" {
+			a.Targets = append(a.Targets, t)
+		}
+	}
+
+	return a
+}
+
+// IsCatchAll returns true if the alias is the catch-all of a domain
+func (a *Alias) IsCatchAll() bool {
+	return strings.HasPrefix(a.Address, "@")
+}
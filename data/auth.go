@@ -0,0 +1,79 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DecodeSaslPlain decodes a base64 encoded PLAIN response (RFC 4616) into the
+// authentication identity and password. An authorization identity different
+// from the authentication identity is refused.
+func DecodeSaslPlain(response string) (user string, password string, err error) {
+	b, err := base64.StdEncoding.DecodeString(response)
+
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid base64 response")
+	}
+
+	parts := bytes.Split(b, []byte{0})
+
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("Malformed PLAIN response")
+	}
+
+	authz, user, password := string(parts[0]), string(parts[1]), string(parts[2])
+
+	if user == "" || password == "" {
+		return "", "", fmt.Errorf("Empty PLAIN credentials")
+	}
+
+	if authz != "" && authz != user {
+		return "", "", fmt.Errorf("Authorization identity <%s> not permitted", authz)
+	}
+
+	return user, password, nil
+}
+
+// DecodeSaslString decodes a single base64 encoded SASL response line, as used
+// by the LOGIN mechanism.
+func DecodeSaslString(response string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(response)
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid base64 response")
+	}
+
+	return string(b), nil
+}
+
+// NewCramChallenge returns a fresh CRAM-MD5 challenge (RFC 2195) in the
+// "<random.timestamp@domain>" form.
+func NewCramChallenge(domain string) string {
+	var r [8]byte
+	rand.Read(r[:])
+	return fmt.Sprintf("<%d.%d@%s>", binary.BigEndian.Uint64(r[:])>>1, time.Now().UnixNano(), domain)
+}
+
+// DecodeCramResponse decodes a base64 encoded CRAM-MD5 response into the user
+// name and the hex digest.
+func DecodeCramResponse(response string) (user string, digest string, err error) {
+	b, err := base64.StdEncoding.DecodeString(response)
+
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid base64 response")
+	}
+
+	s := string(b)
+	idx := strings.LastIndex(s, " ")
+
+	if idx < 1 || idx == len(s)-1 {
+		return "", "", fmt.Errorf("Malformed CRAM-MD5 response")
+	}
+
+	return s[:idx], s[idx+1:], nil
+}
@@ -0,0 +1,727 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/log"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// Message contents keyed by id
+	boltMessages = []byte("Messages")
+
+	// Mailbox entries keyed by id, ids are ObjectId hex so keys sort by
+	// arrival
+	boltEntries = []byte("Entries")
+
+	// Index of "<mailbox>@<domain>\x00<entry id>" for Fetch
+	boltMailboxes = []byte("Mailboxes")
+
+	// Index of "<message id>\x00<entry id>", the copies of a message
+	boltCopies = []byte("Copies")
+
+	// Index of attachment id to message id for LoadAttachment
+	boltAttachments = []byte("Attachments")
+
+	// Users keyed by email and index of user id to email for LoadUser
+	boltUsers   = []byte("Users")
+	boltUserIds = []byte("UserIds")
+
+	// Hosted domains keyed by name
+	boltDomains = []byte("Domains")
+
+	// Aliases keyed by address
+	boltAliases = []byte("Aliases")
+
+	// Outbound queue keyed by id, so in arrival order
+	boltQueue = []byte("Queue")
+
+	boltSpamdb = []byte("SpamDB")
+)
+
+// BoltDB keeps everything in a single local file, documents are encoded
+// with BSON so they have the same shape as in MongoDB
+type BoltDB struct {
+	Config config.DataStoreConfig
+	DB     *bolt.DB
+}
+
+func CreateBoltDB(c config.DataStoreConfig) *BoltDB {
+	log.LogTrace("Opening BoltDB: %s", c.BoltPath)
+	db, err := bolt.Open(c.BoltPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+
+	if err != nil {
+		log.LogError("Error opening BoltDB: %s", err)
+		return nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMessages, boltEntries, boltMailboxes, boltCopies, boltAttachments, boltUsers, boltUserIds, boltDomains, boltAliases, boltQueue, boltSpamdb} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.LogError("Error creating BoltDB buckets: %s", err)
+		db.Close()
+		return nil
+	}
+
+	return &BoltDB{Config: c, DB: db}
+}
+
+func (bdb *BoltDB) Close() {
+	bdb.DB.Close()
+}
+
+// Store saves the content of m once and an entry in the mailbox of every
+// recipient, in one transaction
+func (bdb *BoltDB) Store(m *Message) (string, error) {
+	doc, err := bson.Marshal(contentOf(m))
+
+	if err != nil {
+		log.LogError("Error encoding message: %s", err)
+		return "", err
+	}
+
+	err = bdb.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltMessages).Put([]byte(m.Id), doc); err != nil {
+			return err
+		}
+
+		for _, e := range NewMailboxEntries(m) {
+			if err := putEntry(tx, e); err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(boltMailboxes).Put(boltIndexKey(e.Email(), e.Id), nil); err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(boltCopies).Put(boltIndexKey(m.Id, e.Id), nil); err != nil {
+				return err
+			}
+		}
+
+		for _, a := range m.Attachments {
+			if err := tx.Bucket(boltAttachments).Put([]byte(a.Id), []byte(m.Id)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.LogError("Error inserting message: %s", err)
+		return "", err
+	}
+
+	return m.Id, nil
+}
+
+// Login validates and returns a user object if they exist in the database.
+func (bdb *BoltDB) Login(email, password string) (*User, error) {
+	u, err := bdb.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if ok := Validate_Password(u.Password, password); !ok {
+		log.LogError("Invalid Password: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+// LoginCramMD5 validates a CRAM-MD5 digest of challenge and returns the user
+// object on success.
+func (bdb *BoltDB) LoginCramMD5(email, challenge, digest string) (*User, error) {
+	u, err := bdb.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if u.CramSecret == "" {
+		log.LogError("No CRAM-MD5 secret stored for: %s", u.Email)
+		return nil, fmt.Errorf("CRAM-MD5 not available!")
+	}
+
+	if ok := Validate_CramMD5(u.CramSecret, challenge, digest); !ok {
+		log.LogError("Invalid CRAM-MD5 digest: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+func (bdb *BoltDB) LoadUser(id string) (*User, error) {
+	u := &User{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		email := tx.Bucket(boltUserIds).Get([]byte(id))
+
+		if email == nil {
+			return ErrNotFound
+		}
+
+		return getDocument(tx.Bucket(boltUsers), email, u)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (bdb *BoltDB) StoreUser(u *User) error {
+	u = normalizedUser(u)
+
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(u.Email)) != nil {
+			return fmt.Errorf("User already exists: %s", u.Email)
+		}
+
+		return putUser(tx, u)
+	})
+}
+
+func (bdb *BoltDB) UpdateUser(u *User) error {
+	u = normalizedUser(u)
+
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		email := tx.Bucket(boltUserIds).Get([]byte(u.Id.Hex()))
+
+		if email == nil {
+			return ErrNotFound
+		}
+
+		// The email is the key, drop the old record if it changed
+		if string(email) != u.Email {
+			if err := tx.Bucket(boltUsers).Delete(email); err != nil {
+				return err
+			}
+		}
+
+		return putUser(tx, u)
+	})
+}
+
+func (bdb *BoltDB) IsUserExists(email string) (*User, error) {
+	u := &User{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return getDocument(tx.Bucket(boltUsers), []byte(NormalizeEmail(email)), u)
+	})
+
+	if err != nil {
+		log.LogError("Error finding user: %v", err)
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// List returns a page of the messages delivered to email, newest first.
+// Like the MongoDB listing message content is left out.
+func (bdb *BoltDB) List(email string, start int, limit int) (*Messages, error) {
+	email = NormalizeEmail(email)
+	messages := Messages{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltMailboxes).Cursor()
+		prefix := boltIndexKey(email, "")
+		skipped := 0
+
+		// Start after the last key of the mailbox and walk back
+		k, _ := c.Seek(boltIndexKey(email, "\xff"))
+
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(messages) < limit; k, _ = c.Prev() {
+			if skipped < start {
+				skipped++
+				continue
+			}
+
+			m, err := getEntryMessage(tx, k[len(prefix):])
+
+			if err != nil {
+				return err
+			}
+
+			m.Content = nil
+			m.MIME = nil
+			m.Raw = ""
+			messages = append(messages, *m)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.LogError("Error loading messages: %s", err)
+		return nil, err
+	}
+
+	return &messages, nil
+}
+
+func (bdb *BoltDB) Total(email string) (int, error) {
+	email = NormalizeEmail(email)
+	total := 0
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltMailboxes).Cursor()
+		prefix := boltIndexKey(email, "")
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			total++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.LogError("Error loading message: %s", err)
+		return -1, err
+	}
+
+	return total, nil
+}
+
+func (bdb *BoltDB) Load(id string) (*Message, error) {
+	var result *Message
+
+	err := bdb.DB.View(func(tx *bolt.Tx) (err error) {
+		result, err = getEntryMessage(tx, []byte(id))
+		return err
+	})
+
+	if err != nil {
+		log.LogError("Error loading message: %s", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// LoadAttachment returns the message holding the attachment, with only that
+// attachment set, if the message was delivered to email
+func (bdb *BoltDB) LoadAttachment(email string, id string) (*Message, error) {
+	email = NormalizeEmail(email)
+	m := &Message{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		msgId := tx.Bucket(boltAttachments).Get([]byte(id))
+
+		if msgId == nil {
+			return ErrNotFound
+		}
+
+		c := tx.Bucket(boltCopies).Cursor()
+		prefix := boltIndexKey(string(msgId), "")
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if tx.Bucket(boltMailboxes).Get(boltIndexKey(email, string(k[len(prefix):]))) != nil {
+				return getDocument(tx.Bucket(boltMessages), msgId, m)
+			}
+		}
+
+		return ErrNotFound
+	})
+
+	if err != nil {
+		log.LogError("Error loading attachment: %s", err)
+		return nil, err
+	}
+
+	for _, a := range m.Attachments {
+		if a.Id == id {
+			return &Message{Id: m.Id, Attachments: []*Attachment{a}}, nil
+		}
+	}
+
+	log.LogError("Error loading attachment: %s", ErrNotFound)
+	return nil, ErrNotFound
+}
+
+func (bdb *BoltDB) SetUnread(id string, unread bool) error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		e := &MailboxEntry{}
+
+		if err := getDocument(tx.Bucket(boltEntries), []byte(id), e); err != nil {
+			return err
+		}
+
+		e.Unread = unread
+		return putEntry(tx, e)
+	})
+}
+
+// Fetch returns the messages delivered to email, oldest first
+func (bdb *BoltDB) Fetch(email string) (*Messages, error) {
+	if len(strings.Split(email, "@")) != 2 {
+		return nil, fmt.Errorf("Invalid email address: %s", email)
+	}
+
+	email = NormalizeEmail(email)
+	messages := Messages{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltMailboxes).Cursor()
+		prefix := boltIndexKey(email, "")
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			m, err := getEntryMessage(tx, k[len(prefix):])
+
+			if err != nil {
+				return err
+			}
+
+			messages = append(messages, *m)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.LogError("Error loading messages: %s", err)
+		return nil, err
+	}
+
+	return &messages, nil
+}
+
+// DeleteOne removes a message from one mailbox, its content goes with the
+// last copy
+func (bdb *BoltDB) DeleteOne(id string) error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		e := &MailboxEntry{}
+
+		if err := getDocument(tx.Bucket(boltEntries), []byte(id), e); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltEntries).Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltMailboxes).Delete(boltIndexKey(e.Email(), e.Id)); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltCopies).Delete(boltIndexKey(e.MessageId, e.Id)); err != nil {
+			return err
+		}
+
+		prefix := boltIndexKey(e.MessageId, "")
+
+		if k, _ := tx.Bucket(boltCopies).Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+
+		m := &Message{}
+
+		if err := getDocument(tx.Bucket(boltMessages), []byte(e.MessageId), m); err != nil {
+			return err
+		}
+
+		for _, a := range m.Attachments {
+			if err := tx.Bucket(boltAttachments).Delete([]byte(a.Id)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(boltMessages).Delete([]byte(e.MessageId))
+	})
+}
+
+func (bdb *BoltDB) DeleteAll() error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMessages, boltEntries, boltMailboxes, boltCopies, boltAttachments} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ListDomains returns the hosted domains sorted by name
+func (bdb *BoltDB) ListDomains() ([]Domain, error) {
+	domains := []Domain{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDomains).ForEach(func(k, v []byte) error {
+			d := Domain{}
+
+			if err := bson.Unmarshal(v, &d); err != nil {
+				return err
+			}
+
+			domains = append(domains, d)
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.LogError("Error loading domains: %s", err)
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+func (bdb *BoltDB) LoadDomain(name string) (*Domain, error) {
+	d := &Domain{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return getDocument(tx.Bucket(boltDomains), []byte(name), d)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (bdb *BoltDB) StoreDomain(d *Domain) error {
+	doc, err := bson.Marshal(d)
+
+	if err != nil {
+		return err
+	}
+
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDomains).Put([]byte(d.Name), doc)
+	})
+}
+
+func (bdb *BoltDB) DeleteDomain(name string) error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDomains).Delete([]byte(name))
+	})
+}
+
+// ListAliases returns the aliases sorted by address
+func (bdb *BoltDB) ListAliases() ([]Alias, error) {
+	aliases := []Alias{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAliases).ForEach(func(k, v []byte) error {
+			a := Alias{}
+
+			if err := bson.Unmarshal(v, &a); err != nil {
+				return err
+			}
+
+			aliases = append(aliases, a)
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.LogError("Error loading aliases: %s", err)
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func (bdb *BoltDB) LoadAlias(address string) (*Alias, error) {
+	a := &Alias{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return getDocument(tx.Bucket(boltAliases), []byte(address), a)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (bdb *BoltDB) StoreAlias(a *Alias) error {
+	doc, err := bson.Marshal(a)
+
+	if err != nil {
+		return err
+	}
+
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAliases).Put([]byte(a.Address), doc)
+	})
+}
+
+func (bdb *BoltDB) DeleteAlias(address string) error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAliases).Delete([]byte(address))
+	})
+}
+
+// ListQueue returns the queued messages due at or before due, oldest first
+func (bdb *BoltDB) ListQueue(due time.Time) ([]QueuedMessage, error) {
+	queue := []QueuedMessage{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltQueue).ForEach(func(k, v []byte) error {
+			q := QueuedMessage{}
+
+			if err := bson.Unmarshal(v, &q); err != nil {
+				return err
+			}
+
+			if !q.NextAttempt.After(due) {
+				queue = append(queue, q)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		log.LogError("Error loading queue: %s", err)
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+func (bdb *BoltDB) LoadQueued(id string) (*QueuedMessage, error) {
+	q := &QueuedMessage{}
+
+	err := bdb.DB.View(func(tx *bolt.Tx) error {
+		return getDocument(tx.Bucket(boltQueue), []byte(id), q)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (bdb *BoltDB) StoreQueued(q *QueuedMessage) error {
+	doc, err := bson.Marshal(q)
+
+	if err != nil {
+		return err
+	}
+
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltQueue).Put([]byte(q.Id.Hex()), doc)
+	})
+}
+
+func (bdb *BoltDB) DeleteQueued(id string) error {
+	return bdb.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltQueue).Delete([]byte(id))
+	})
+}
+
+func (bdb *BoltDB) StoreSpamIp(s SpamIP) (string, error) {
+	doc, err := bson.Marshal(s)
+
+	if err == nil {
+		err = bdb.DB.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(boltSpamdb).Put([]byte(s.Id.Hex()), doc)
+		})
+	}
+
+	if err != nil {
+		log.LogError("Error inserting greylist ip: %s", err)
+		return "", err
+	}
+
+	return s.Id.Hex(), nil
+}
+
+// boltIndexKey returns an index key, or the prefix of all keys of owner when
+// id is empty
+func boltIndexKey(owner string, id string) []byte {
+	return []byte(owner + "\x00" + id)
+}
+
+// getEntryMessage returns the message of mailbox entry id
+func getEntryMessage(tx *bolt.Tx, id []byte) (*Message, error) {
+	e := &MailboxEntry{}
+	m := &Message{}
+
+	if err := getDocument(tx.Bucket(boltEntries), id, e); err != nil {
+		return nil, err
+	}
+
+	if err := getDocument(tx.Bucket(boltMessages), []byte(e.MessageId), m); err != nil {
+		return nil, err
+	}
+
+	return e.Message(m), nil
+}
+
+// putEntry writes a mailbox entry
+func putEntry(tx *bolt.Tx, e *MailboxEntry) error {
+	doc, err := bson.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltEntries).Put([]byte(e.Id), doc)
+}
+
+// getDocument decodes the BSON document stored under key
+func getDocument(b *bolt.Bucket, key []byte, v interface{}) error {
+	doc := b.Get(key)
+
+	if doc == nil {
+		return ErrNotFound
+	}
+
+	return bson.Unmarshal(doc, v)
+}
+
+// putUser writes the user record and its id index
+func putUser(tx *bolt.Tx, u *User) error {
+	doc, err := bson.Marshal(u)
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(boltUsers).Put([]byte(u.Email), doc); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltUserIds).Put([]byte(u.Id.Hex()), []byte(u.Email))
+}
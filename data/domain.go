@@ -0,0 +1,47 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Domain is a mail domain hosted by this server, mail for its addresses is
+// delivered locally. With PlusAddressing mail for user+ext@domain goes to
+// user@domain.
+type Domain struct {
+	Id             bson.ObjectId `bson:"_id"`
+	Name           string
+	CreatedAt      time.Time
+	IsActive       bool
+	PlusAddressing bool
+}
+
+// NewDomain returns an active domain with plus addressing, names are kept in
+// lower case
+func NewDomain(name string) *Domain {
+	return &Domain{
+		Id:             bson.NewObjectId(),
+		Name:           strings.ToLower(strings.TrimSpace(name)),
+		CreatedAt:      time.Now(),
+		IsActive:       true,
+		PlusAddressing: true,
+	}
+}
+
+// NormalizeEmail returns email as mailboxes and users are stored and looked up
+// by: in lower case, without surrounding space
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// DomainOf returns the domain part of email in lower case, or "" if email has
+// none
+func DomainOf(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return strings.ToLower(email[i+1:])
+	}
+
+	return ""
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Folder new mail is delivered into
+const DefaultFolder = "INBOX"
+
+// MailboxEntry is the copy of a message in the mailbox of one recipient.
+// Entries of the same message share its content, but have their own flags,
+// folder and deletion state.
+type MailboxEntry struct {
+	Id        string
+	MessageId string
+	Mailbox   string
+	Domain    string
+	Folder    string
+	Created   time.Time
+	Unread    bool
+	Starred   bool
+}
+
+// NewMailboxEntries returns an unread inbox entry for every recipient of m,
+// a recipient given more than once gets a single copy. Mailboxes are named in
+// lower case.
+func NewMailboxEntries(m *Message) []*MailboxEntry {
+	entries := make([]*MailboxEntry, 0, len(m.To))
+	seen := make(map[string]bool)
+
+	for _, to := range m.To {
+		mailbox, domain := strings.ToLower(to.Mailbox), strings.ToLower(to.Domain)
+		email := mailbox + "@" + domain
+
+		if seen[email] {
+			continue
+		}
+
+		seen[email] = true
+		entries = append(entries, &MailboxEntry{
+			Id:        bson.NewObjectId().Hex(),
+			MessageId: m.Id,
+			Mailbox:   mailbox,
+			Domain:    domain,
+			Folder:    DefaultFolder,
+			Created:   m.Created,
+			Unread:    true,
+		})
+	}
+
+	return entries
+}
+
+// Email returns the address of the mailbox holding the entry
+func (e *MailboxEntry) Email() string {
+	return e.Mailbox + "@" + e.Domain
+}
+
+// Message returns the content m as seen from the mailbox: with the id and
+// flags of the entry and the mailbox as only recipient, so other recipients
+// of the envelope (Bcc included) are not disclosed
+func (e *MailboxEntry) Message(m *Message) *Message {
+	cp := *m
+	cp.Id = e.Id
+	cp.To = []*Path{{Mailbox: e.Mailbox, Domain: e.Domain}}
+	cp.Unread = e.Unread
+	cp.Starred = e.Starred
+	return &cp
+}
+
+// contentOf returns the shared content of m, without the envelope recipients
+// and the per mailbox flags
+func contentOf(m *Message) *Message {
+	cp := *m
+	cp.To = nil
+	cp.Unread = false
+	cp.Starred = false
+	return &cp
+}
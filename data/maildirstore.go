@@ -0,0 +1,877 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/log"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// Message id we put in the unique part of the file name
+	maildirIdRegex = regexp.MustCompile(`R([0-9a-f]{24})[.,:]`)
+
+	// Delivery counter for unique file names
+	maildirCounter int64
+)
+
+// MaildirStore delivers messages into <root>/<domain>/<user>/Maildir, users
+// and spam records are kept in JSON files under the root and the outbound
+// queue in one JSON file per message under <root>/queue
+type MaildirStore struct {
+	Config   config.DataStoreConfig
+	root     string
+	hostname string
+	mu       sync.RWMutex
+	users    map[string]*User
+	domains  map[string]*Domain
+	aliases  map[string]*Alias
+	spamIps  []SpamIP
+	idsMu    sync.RWMutex
+	ids      map[string]string // Message id to the owner of its Maildir
+}
+
+// maildirFile is a message file found in a Maildir
+type maildirFile struct {
+	Path    string
+	Id      string
+	Owner   string
+	Created time.Time
+	Flags   string
+}
+
+func CreateMaildirStore(c config.DataStoreConfig) *MaildirStore {
+	log.LogTrace("Opening Maildir storage: %s", c.MaildirPath)
+
+	if err := os.MkdirAll(filepath.Join(c.MaildirPath, "queue"), 0700); err != nil {
+		log.LogError("Error creating Maildir root: %s", err)
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// Characters not allowed in the host part of the file name (maildir(5))
+	hostname = strings.Replace(hostname, "/", "\\057", -1)
+	hostname = strings.Replace(hostname, ":", "\\072", -1)
+
+	mdir := &MaildirStore{
+		Config:   c,
+		root:     c.MaildirPath,
+		hostname: hostname,
+		users:    make(map[string]*User),
+		domains:  make(map[string]*Domain),
+		aliases:  make(map[string]*Alias),
+		spamIps:  make([]SpamIP, 0),
+		ids:      make(map[string]string),
+	}
+
+	if err := mdir.readJSON("users.json", &mdir.users); err != nil {
+		log.LogError("Error loading users: %s", err)
+		return nil
+	}
+
+	// Users written before addresses were normalized
+	for email, u := range mdir.users {
+		if email != NormalizeEmail(email) {
+			delete(mdir.users, email)
+			mdir.users[NormalizeEmail(email)] = normalizedUser(u)
+		}
+	}
+
+	if err := mdir.readJSON("domains.json", &mdir.domains); err != nil {
+		log.LogError("Error loading domains: %s", err)
+		return nil
+	}
+
+	if err := mdir.readJSON("aliases.json", &mdir.aliases); err != nil {
+		log.LogError("Error loading aliases: %s", err)
+		return nil
+	}
+
+	if err := mdir.readJSON("spam.json", &mdir.spamIps); err != nil {
+		log.LogError("Error loading spam records: %s", err)
+		return nil
+	}
+
+	// Fills the id index, lookups go to the Maildir of the owner only
+	if _, err := mdir.allFiles(); err != nil {
+		log.LogError("Error indexing Maildirs: %s", err)
+		return nil
+	}
+
+	return mdir
+}
+
+func (mdir *MaildirStore) Close() {
+	// Nothing to release, every write is flushed right away
+}
+
+// Store writes the message once and links it into the Maildir of every
+// recipient. Every link is a copy with its own name, so its own id and flags.
+// Nothing is delivered if a recipient has no user account.
+func (mdir *MaildirStore) Store(m *Message) (string, error) {
+	raw := m.Raw
+
+	if raw == "" {
+		raw = m.RawMessage()
+	}
+
+	entries := NewMailboxEntries(m)
+
+	for _, e := range entries {
+		if _, err := mdir.IsUserExists(e.Email()); err != nil {
+			log.LogError("No Maildir for <%s>, not delivering message %s", e.Email(), m.Id)
+			return "", fmt.Errorf("No Maildir for <%s>", e.Email())
+		}
+	}
+
+	content := ""
+
+	for _, e := range entries {
+		email := e.Email()
+		path, err := mdir.deliver(email, e.Id, raw, content)
+
+		if err != nil {
+			log.LogError("Error delivering message to <%s>: %s", email, err)
+			return "", err
+		}
+
+		if content == "" {
+			content = path
+		}
+	}
+
+	if content == "" {
+		return "", fmt.Errorf("No local mailbox for message %s", m.Id)
+	}
+
+	return m.Id, nil
+}
+
+// deliver puts the message into tmp/ and moves it into new/ (maildir(5)). It
+// is hard linked from src when given, written out otherwise.
+func (mdir *MaildirStore) deliver(email string, id string, raw string, src string) (string, error) {
+	dir, err := mdir.mailboxDir(email)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%dR%s.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddInt64(&maildirCounter, 1), id, mdir.hostname, len(raw))
+	tmp := filepath.Join(dir, "tmp", name)
+
+	if src == "" || os.Link(src, tmp) != nil {
+		if err := ioutil.WriteFile(tmp, []byte(raw), 0600); err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(dir, "new", name)
+
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+
+	mdir.index(id, email)
+	return path, nil
+}
+
+// Login validates and returns a user object if they exist in the store.
+func (mdir *MaildirStore) Login(email, password string) (*User, error) {
+	u, err := mdir.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if ok := Validate_Password(u.Password, password); !ok {
+		log.LogError("Invalid Password: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+// LoginCramMD5 validates a CRAM-MD5 digest of challenge and returns the user
+// object on success.
+func (mdir *MaildirStore) LoginCramMD5(email, challenge, digest string) (*User, error) {
+	u, err := mdir.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if u.CramSecret == "" {
+		log.LogError("No CRAM-MD5 secret stored for: %s", u.Email)
+		return nil, fmt.Errorf("CRAM-MD5 not available!")
+	}
+
+	if ok := Validate_CramMD5(u.CramSecret, challenge, digest); !ok {
+		log.LogError("Invalid CRAM-MD5 digest: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+func (mdir *MaildirStore) LoadUser(id string) (*User, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	for _, u := range mdir.users {
+		if u.Id.Hex() == id {
+			cp := *u
+			return &cp, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (mdir *MaildirStore) StoreUser(u *User) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	u = normalizedUser(u)
+	mdir.users[u.Email] = u
+	return mdir.writeJSON("users.json", mdir.users)
+}
+
+func (mdir *MaildirStore) UpdateUser(u *User) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	for email, existing := range mdir.users {
+		if existing.Id == u.Id {
+			delete(mdir.users, email)
+			u = normalizedUser(u)
+			mdir.users[u.Email] = u
+			return mdir.writeJSON("users.json", mdir.users)
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (mdir *MaildirStore) IsUserExists(email string) (*User, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	u, ok := mdir.users[NormalizeEmail(email)]
+
+	if !ok {
+		log.LogError("Error finding user: %v", ErrNotFound)
+		return nil, ErrNotFound
+	}
+
+	cp := *u
+	return &cp, nil
+}
+
+// List returns a page of the messages in the Maildir of email, newest first
+func (mdir *MaildirStore) List(email string, start int, limit int) (*Messages, error) {
+	files, err := mdir.userFiles(email)
+
+	if err != nil {
+		log.LogError("Error loading messages: %s", err)
+		return nil, err
+	}
+
+	messages := Messages{}
+
+	for i := len(files) - 1 - start; i >= 0 && len(messages) < limit; i-- {
+		m, err := mdir.readMessage(files[i])
+
+		if err != nil {
+			log.LogError("Error loading message: %s", err)
+			continue
+		}
+
+		messages = append(messages, *m)
+	}
+
+	return &messages, nil
+}
+
+func (mdir *MaildirStore) Total(email string) (int, error) {
+	files, err := mdir.userFiles(email)
+
+	if err != nil {
+		log.LogError("Error loading message: %s", err)
+		return -1, err
+	}
+
+	return len(files), nil
+}
+
+func (mdir *MaildirStore) Load(id string) (*Message, error) {
+	f, err := mdir.findFile(id)
+
+	if err != nil {
+		log.LogError("Error loading message: %s", err)
+		return nil, err
+	}
+
+	return mdir.readMessage(f)
+}
+
+// LoadAttachment returns the message holding the attachment, with only that
+// attachment set, if it is in the Maildir of email. Attachment ids start with
+// the message id.
+func (mdir *MaildirStore) LoadAttachment(email string, id string) (*Message, error) {
+	if len(id) <= 24 {
+		return nil, ErrNotFound
+	}
+
+	files, err := mdir.userFiles(email)
+
+	if err != nil {
+		log.LogError("Error loading attachment: %s", err)
+		return nil, err
+	}
+
+	var m *Message
+
+	for _, f := range files {
+		if f.Id == id[:24] {
+			m, err = mdir.readMessage(f)
+			break
+		}
+	}
+
+	if m == nil || err != nil {
+		log.LogError("Error loading attachment: %s", ErrNotFound)
+		return nil, ErrNotFound
+	}
+
+	for _, a := range m.Attachments {
+		if a.Id == id {
+			return &Message{Id: m.Id, Attachments: []*Attachment{a}}, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// SetUnread moves the message into cur/ and updates its Seen flag
+func (mdir *MaildirStore) SetUnread(id string, unread bool) error {
+	f, err := mdir.findFile(id)
+
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	flags := strings.Replace(f.Flags, "S", "", -1)
+
+	if !unread {
+		flags = flags + "S"
+	}
+
+	// Flags are kept in ASCII order (maildir(5))
+	chars := strings.Split(flags, "")
+	sort.Strings(chars)
+
+	name := strings.SplitN(filepath.Base(f.Path), ":", 2)[0] + ":2," + strings.Join(chars, "")
+	cur := filepath.Join(filepath.Dir(filepath.Dir(f.Path)), "cur", name)
+	return os.Rename(f.Path, cur)
+}
+
+// Fetch returns the messages in the Maildir of email, oldest first
+func (mdir *MaildirStore) Fetch(email string) (*Messages, error) {
+	files, err := mdir.userFiles(email)
+
+	if err != nil {
+		log.LogError("Error loading messages: %s", err)
+		return nil, err
+	}
+
+	messages := Messages{}
+
+	for _, f := range files {
+		m, err := mdir.readMessage(f)
+
+		if err != nil {
+			log.LogError("Error loading message: %s", err)
+			continue
+		}
+
+		messages = append(messages, *m)
+	}
+
+	return &messages, nil
+}
+
+func (mdir *MaildirStore) DeleteOne(id string) error {
+	f, err := mdir.findFile(id)
+
+	if err == ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(f.Path); err != nil {
+		return err
+	}
+
+	mdir.index(id, "")
+	return nil
+}
+
+func (mdir *MaildirStore) DeleteAll() error {
+	files, err := mdir.allFiles()
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := os.Remove(f.Path); err != nil {
+			return err
+		}
+
+		mdir.index(f.Id, "")
+	}
+
+	return nil
+}
+
+// ListDomains returns the hosted domains sorted by name
+func (mdir *MaildirStore) ListDomains() ([]Domain, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	domains := make([]Domain, 0, len(mdir.domains))
+
+	for _, d := range mdir.domains {
+		domains = append(domains, *d)
+	}
+
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+
+	return domains, nil
+}
+
+func (mdir *MaildirStore) LoadDomain(name string) (*Domain, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	d, ok := mdir.domains[name]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	cp := *d
+	return &cp, nil
+}
+
+func (mdir *MaildirStore) StoreDomain(d *Domain) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	cp := *d
+	mdir.domains[d.Name] = &cp
+	return mdir.writeJSON("domains.json", mdir.domains)
+}
+
+func (mdir *MaildirStore) DeleteDomain(name string) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	delete(mdir.domains, name)
+	return mdir.writeJSON("domains.json", mdir.domains)
+}
+
+// ListAliases returns the aliases sorted by address
+func (mdir *MaildirStore) ListAliases() ([]Alias, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	aliases := make([]Alias, 0, len(mdir.aliases))
+
+	for _, a := range mdir.aliases {
+		aliases = append(aliases, *a)
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Address < aliases[j].Address
+	})
+
+	return aliases, nil
+}
+
+func (mdir *MaildirStore) LoadAlias(address string) (*Alias, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	a, ok := mdir.aliases[address]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	cp := *a
+	return &cp, nil
+}
+
+func (mdir *MaildirStore) StoreAlias(a *Alias) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	cp := *a
+	mdir.aliases[a.Address] = &cp
+	return mdir.writeJSON("aliases.json", mdir.aliases)
+}
+
+func (mdir *MaildirStore) DeleteAlias(address string) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	delete(mdir.aliases, address)
+	return mdir.writeJSON("aliases.json", mdir.aliases)
+}
+
+// ListQueue returns the queued messages due at or before due, oldest first
+func (mdir *MaildirStore) ListQueue(due time.Time) ([]QueuedMessage, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(mdir.root, "queue"))
+
+	if err != nil {
+		log.LogError("Error loading queue: %s", err)
+		return nil, err
+	}
+
+	queue := make([]QueuedMessage, 0)
+
+	// File names are ids, so ReadDir lists them oldest first
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		q := QueuedMessage{}
+
+		if err := mdir.readJSON(filepath.Join("queue", f.Name()), &q); err != nil {
+			log.LogError("Error loading queued message %s: %s", f.Name(), err)
+			continue
+		}
+
+		if !q.NextAttempt.After(due) {
+			queue = append(queue, q)
+		}
+	}
+
+	return queue, nil
+}
+
+func (mdir *MaildirStore) LoadQueued(id string) (*QueuedMessage, error) {
+	mdir.mu.RLock()
+	defer mdir.mu.RUnlock()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+
+	name := filepath.Join("queue", id+".json")
+
+	if _, err := os.Stat(filepath.Join(mdir.root, name)); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	q := &QueuedMessage{}
+
+	if err := mdir.readJSON(name, q); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (mdir *MaildirStore) StoreQueued(q *QueuedMessage) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	return mdir.writeJSON(filepath.Join("queue", q.Id.Hex()+".json"), q)
+}
+
+func (mdir *MaildirStore) DeleteQueued(id string) error {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+
+	err := os.Remove(filepath.Join(mdir.root, "queue", id+".json"))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (mdir *MaildirStore) StoreSpamIp(s SpamIP) (string, error) {
+	mdir.mu.Lock()
+	defer mdir.mu.Unlock()
+
+	mdir.spamIps = append(mdir.spamIps, s)
+
+	if err := mdir.writeJSON("spam.json", mdir.spamIps); err != nil {
+		log.LogError("Error inserting greylist ip: %s", err)
+		return "", err
+	}
+
+	return s.Id.Hex(), nil
+}
+
+// mailboxDir returns the Maildir of email, refusing names which could
+// escape the storage root
+func (mdir *MaildirStore) mailboxDir(email string) (string, error) {
+	s := strings.Split(strings.ToLower(email), "@")
+
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", fmt.Errorf("Invalid email address: %s", email)
+	}
+
+	for _, part := range s {
+		if strings.ContainsAny(part, "/\\") || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("Invalid email address: %s", email)
+		}
+	}
+
+	return filepath.Join(mdir.root, s[1], s[0], "Maildir"), nil
+}
+
+// mailboxFiles lists the messages in new/ and cur/ of a Maildir, oldest
+// first
+func (mdir *MaildirStore) mailboxFiles(dir string, owner string) ([]maildirFile, error) {
+	files := make([]maildirFile, 0)
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			f := newMaildirFile(filepath.Join(dir, sub, e.Name()), owner, e.ModTime())
+			files = append(files, f)
+			mdir.index(f.Id, owner)
+		}
+	}
+
+	sortMaildirFiles(files)
+	return files, nil
+}
+
+// userFiles lists the messages in the Maildir of email, oldest first
+func (mdir *MaildirStore) userFiles(email string) ([]maildirFile, error) {
+	dir, err := mdir.mailboxDir(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mdir.mailboxFiles(dir, NormalizeEmail(email))
+}
+
+// allFiles lists the messages of every Maildir, oldest first
+func (mdir *MaildirStore) allFiles() ([]maildirFile, error) {
+	dirs, err := filepath.Glob(filepath.Join(mdir.root, "*", "*", "Maildir"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]maildirFile, 0)
+
+	for _, dir := range dirs {
+		user := filepath.Base(filepath.Dir(dir))
+		domain := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		mf, err := mdir.mailboxFiles(dir, user+"@"+domain)
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, mf...)
+	}
+
+	sortMaildirFiles(files)
+	return files, nil
+}
+
+// findFile returns the file holding message id, it is looked for in the
+// Maildir of its owner only
+func (mdir *MaildirStore) findFile(id string) (maildirFile, error) {
+	mdir.idsMu.RLock()
+	owner, ok := mdir.ids[id]
+	mdir.idsMu.RUnlock()
+
+	if !ok {
+		return maildirFile{}, ErrNotFound
+	}
+
+	files, err := mdir.userFiles(owner)
+
+	if err != nil {
+		return maildirFile{}, err
+	}
+
+	for _, f := range files {
+		if f.Id == id {
+			return f, nil
+		}
+	}
+
+	mdir.index(id, "")
+	return maildirFile{}, ErrNotFound
+}
+
+// index records the owner of message id, an empty owner removes it. Every
+// listing of a Maildir updates the index, so files delivered by others are
+// found too.
+func (mdir *MaildirStore) index(id string, owner string) {
+	mdir.idsMu.Lock()
+	defer mdir.idsMu.Unlock()
+
+	if owner == "" {
+		delete(mdir.ids, id)
+	} else {
+		mdir.ids[id] = owner
+	}
+}
+
+// readMessage loads and parses a message file
+func (mdir *MaildirStore) readMessage(f maildirFile) (*Message, error) {
+	b, err := ioutil.ReadFile(f.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := ParseRawMessage(f.Id, string(b))
+	m.To = []*Path{PathFromString(f.Owner)}
+	m.Created = f.Created
+	m.Unread = !strings.Contains(f.Flags, "S")
+	m.Starred = strings.Contains(f.Flags, "F")
+	return m, nil
+}
+
+func (mdir *MaildirStore) readJSON(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(mdir.root, name))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON replaces a JSON file atomically. Callers hold the lock.
+func (mdir *MaildirStore) writeJSON(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(mdir.root, filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(mdir.root, name))
+}
+
+// newMaildirFile takes the message id, delivery time and flags from the file
+// name. Files we did not deliver get an id hashed from their unique name.
+func newMaildirFile(path string, owner string, modTime time.Time) maildirFile {
+	name := filepath.Base(path)
+	f := maildirFile{Path: path, Owner: owner, Created: modTime}
+	parts := strings.SplitN(name, ":2,", 2)
+
+	if len(parts) == 2 {
+		f.Flags = parts[1]
+	}
+
+	if m := maildirIdRegex.FindStringSubmatch(parts[0] + "."); m != nil {
+		f.Id = m[1]
+	} else {
+		f.Id = fmt.Sprintf("%x", sha1.Sum([]byte(parts[0])))[:24]
+	}
+
+	if idx := strings.Index(name, "."); idx > 0 {
+		if secs, err := strconv.ParseInt(name[:idx], 10, 64); err == nil {
+			f.Created = time.Unix(secs, 0)
+		}
+	}
+
+	return f
+}
+
+// sortMaildirFiles orders files by delivery time, then by unique name for
+// messages delivered in the same second
+func sortMaildirFiles(files []maildirFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].Created.Equal(files[j].Created) {
+			return files[i].Created.Before(files[j].Created)
+		}
+
+		return filepath.Base(files[i].Path) < filepath.Base(files[j].Path)
+	})
+}
@@ -0,0 +1,445 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/log"
+)
+
+// MemoryStore keeps everything in process memory, it is meant for
+// development and tests and loses all data on restart
+type MemoryStore struct {
+	Config   config.DataStoreConfig
+	mu       sync.RWMutex
+	messages map[string]*Message
+	entries  []*MailboxEntry
+	users    map[string]*User
+	domains  map[string]*Domain
+	aliases  map[string]*Alias
+	queue    map[string]*QueuedMessage
+	spamIps  []SpamIP
+}
+
+func CreateMemoryStore(c config.DataStoreConfig) *MemoryStore {
+	return &MemoryStore{
+		Config:   c,
+		messages: make(map[string]*Message),
+		entries:  make([]*MailboxEntry, 0),
+		users:    make(map[string]*User),
+		domains:  make(map[string]*Domain),
+		aliases:  make(map[string]*Alias),
+		queue:    make(map[string]*QueuedMessage),
+		spamIps:  make([]SpamIP, 0),
+	}
+}
+
+func (mem *MemoryStore) Close() {
+	// Nothing to release
+}
+
+// Store keeps the content of m once and puts a copy in the mailbox of every
+// recipient
+func (mem *MemoryStore) Store(m *Message) (string, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.messages[m.Id] = contentOf(m)
+	mem.entries = append(mem.entries, NewMailboxEntries(m)...)
+	return m.Id, nil
+}
+
+// Login validates and returns a user object if they exist in the store.
+func (mem *MemoryStore) Login(email, password string) (*User, error) {
+	u, err := mem.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if ok := Validate_Password(u.Password, password); !ok {
+		log.LogError("Invalid Password: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+// LoginCramMD5 validates a CRAM-MD5 digest of challenge and returns the user
+// object on success.
+func (mem *MemoryStore) LoginCramMD5(email, challenge, digest string) (*User, error) {
+	u, err := mem.IsUserExists(email)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if u.CramSecret == "" {
+		log.LogError("No CRAM-MD5 secret stored for: %s", u.Email)
+		return nil, fmt.Errorf("CRAM-MD5 not available!")
+	}
+
+	if ok := Validate_CramMD5(u.CramSecret, challenge, digest); !ok {
+		log.LogError("Invalid CRAM-MD5 digest: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+func (mem *MemoryStore) LoadUser(id string) (*User, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	for _, u := range mem.users {
+		if u.Id.Hex() == id {
+			cp := *u
+			return &cp, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (mem *MemoryStore) StoreUser(u *User) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	u = normalizedUser(u)
+	mem.users[u.Email] = u
+	return nil
+}
+
+func (mem *MemoryStore) UpdateUser(u *User) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	for email, existing := range mem.users {
+		if existing.Id == u.Id {
+			delete(mem.users, email)
+			u = normalizedUser(u)
+			mem.users[u.Email] = u
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (mem *MemoryStore) IsUserExists(email string) (*User, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	u, ok := mem.users[NormalizeEmail(email)]
+
+	if !ok {
+		log.LogError("Error finding user: %v", ErrNotFound)
+		return nil, ErrNotFound
+	}
+
+	cp := *u
+	return &cp, nil
+}
+
+// List returns a page of the messages delivered to email, newest first
+func (mem *MemoryStore) List(email string, start int, limit int) (*Messages, error) {
+	all, err := mem.Fetch(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := Messages{}
+
+	for i := len(*all) - 1 - start; i >= 0 && len(messages) < limit; i-- {
+		messages = append(messages, (*all)[i])
+	}
+
+	return &messages, nil
+}
+
+func (mem *MemoryStore) Total(email string) (int, error) {
+	all, err := mem.Fetch(email)
+
+	if err != nil {
+		return -1, err
+	}
+
+	return len(*all), nil
+}
+
+func (mem *MemoryStore) Load(id string) (*Message, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	if i := mem.index(id); i >= 0 {
+		e := mem.entries[i]
+		return e.Message(mem.messages[e.MessageId]), nil
+	}
+
+	log.LogError("Error loading message: %s", ErrNotFound)
+	return nil, ErrNotFound
+}
+
+// LoadAttachment returns the message holding the attachment, with only that
+// attachment set, if the message was delivered to email
+func (mem *MemoryStore) LoadAttachment(email string, id string) (*Message, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	email = NormalizeEmail(email)
+
+	for _, e := range mem.entries {
+		if e.Email() != email {
+			continue
+		}
+
+		for _, a := range mem.messages[e.MessageId].Attachments {
+			if a.Id == id {
+				return &Message{Id: e.Id, Attachments: []*Attachment{a}}, nil
+			}
+		}
+	}
+
+	log.LogError("Error loading attachment: %s", ErrNotFound)
+	return nil, ErrNotFound
+}
+
+func (mem *MemoryStore) SetUnread(id string, unread bool) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if i := mem.index(id); i >= 0 {
+		mem.entries[i].Unread = unread
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+// Fetch returns the messages delivered to email, oldest first
+func (mem *MemoryStore) Fetch(email string) (*Messages, error) {
+	if len(strings.Split(email, "@")) != 2 {
+		return nil, fmt.Errorf("Invalid email address: %s", email)
+	}
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	email = NormalizeEmail(email)
+	messages := Messages{}
+
+	for _, e := range mem.entries {
+		if e.Email() == email {
+			messages = append(messages, *e.Message(mem.messages[e.MessageId]))
+		}
+	}
+
+	return &messages, nil
+}
+
+// DeleteOne removes a message from one mailbox, its content goes with the
+// last copy
+func (mem *MemoryStore) DeleteOne(id string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	i := mem.index(id)
+
+	if i < 0 {
+		return nil
+	}
+
+	msgId := mem.entries[i].MessageId
+	mem.entries = append(mem.entries[:i], mem.entries[i+1:]...)
+
+	for _, e := range mem.entries {
+		if e.MessageId == msgId {
+			return nil
+		}
+	}
+
+	delete(mem.messages, msgId)
+	return nil
+}
+
+func (mem *MemoryStore) DeleteAll() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.messages = make(map[string]*Message)
+	mem.entries = make([]*MailboxEntry, 0)
+	return nil
+}
+
+// ListDomains returns the hosted domains sorted by name
+func (mem *MemoryStore) ListDomains() ([]Domain, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	domains := make([]Domain, 0, len(mem.domains))
+
+	for _, d := range mem.domains {
+		domains = append(domains, *d)
+	}
+
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+
+	return domains, nil
+}
+
+func (mem *MemoryStore) LoadDomain(name string) (*Domain, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	d, ok := mem.domains[name]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	cp := *d
+	return &cp, nil
+}
+
+func (mem *MemoryStore) StoreDomain(d *Domain) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	cp := *d
+	mem.domains[d.Name] = &cp
+	return nil
+}
+
+func (mem *MemoryStore) DeleteDomain(name string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	delete(mem.domains, name)
+	return nil
+}
+
+// ListAliases returns the aliases sorted by address
+func (mem *MemoryStore) ListAliases() ([]Alias, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	aliases := make([]Alias, 0, len(mem.aliases))
+
+	for _, a := range mem.aliases {
+		aliases = append(aliases, *a)
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Address < aliases[j].Address
+	})
+
+	return aliases, nil
+}
+
+func (mem *MemoryStore) LoadAlias(address string) (*Alias, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	a, ok := mem.aliases[address]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	cp := *a
+	return &cp, nil
+}
+
+func (mem *MemoryStore) StoreAlias(a *Alias) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	cp := *a
+	mem.aliases[a.Address] = &cp
+	return nil
+}
+
+func (mem *MemoryStore) DeleteAlias(address string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	delete(mem.aliases, address)
+	return nil
+}
+
+// ListQueue returns the queued messages due at or before due, oldest first
+func (mem *MemoryStore) ListQueue(due time.Time) ([]QueuedMessage, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	queue := make([]QueuedMessage, 0)
+
+	for _, q := range mem.queue {
+		if !q.NextAttempt.After(due) {
+			queue = append(queue, *copyQueued(q))
+		}
+	}
+
+	sort.Slice(queue, func(i, j int) bool {
+		return queue[i].Id.Hex() < queue[j].Id.Hex()
+	})
+
+	return queue, nil
+}
+
+func (mem *MemoryStore) LoadQueued(id string) (*QueuedMessage, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	q, ok := mem.queue[id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyQueued(q), nil
+}
+
+func (mem *MemoryStore) StoreQueued(q *QueuedMessage) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.queue[q.Id.Hex()] = copyQueued(q)
+	return nil
+}
+
+func (mem *MemoryStore) DeleteQueued(id string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	delete(mem.queue, id)
+	return nil
+}
+
+func (mem *MemoryStore) StoreSpamIp(s SpamIP) (string, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.spamIps = append(mem.spamIps, s)
+	return s.Id.Hex(), nil
+}
+
+// index returns the position of mailbox entry id, or -1. Callers hold the
+// lock.
+func (mem *MemoryStore) index(id string) int {
+	for i, e := range mem.entries {
+		if e.Id == id {
+			return i
+		}
+	}
+
+	return -1
+}
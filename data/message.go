@@ -30,6 +30,7 @@ type Message struct {
 	Ip          string
 	Content     *Content
 	MIME        *MIMEBody
+	Raw         string
 	Starred     bool
 	Unread      bool
 }
@@ -82,6 +83,20 @@ type MessageHead struct {
 	Size int
 }
 
+// IsDeliveredTo returns true if email is one of the recipients of the
+// message, case is ignored
+func (m *Message) IsDeliveredTo(email string) bool {
+	email = NormalizeEmail(email)
+
+	for _, to := range m.To {
+		if NormalizeEmail(to.Mailbox+"@"+to.Domain) == email {
+			return true
+		}
+	}
+
+	return false
+}
+
 // TODO support nested MIME content
 func ParseSMTPMessage(m *config.SMTPMessage, hostname string, mimeParser bool) *Message {
 	arr := make([]*Path, 0)
@@ -101,33 +116,7 @@ func ParseSMTPMessage(m *config.SMTPMessage, hostname string, mimeParser bool) *
 	}
 
 	if mimeParser {
-		msg.Content = &Content{Size: len(m.Data), Headers: make(map[string][]string, 0), Body: m.Data}
-
-		// Read mail using standard mail package
-		if rm, err := mail.ReadMessage(bytes.NewBufferString(m.Data)); err == nil {
-			log.LogTrace("Reading Mail Message")
-			msg.Content.Size = len(m.Data)
-			msg.Content.Headers = rm.Header
-			msg.Subject = MimeHeaderDecode(rm.Header.Get("Subject"))
-
-			if mt, p, err := mime.ParseMediaType(rm.Header.Get("Content-Type")); err == nil {
-				if strings.HasPrefix(mt, "multipart/") {
-					log.LogTrace("Parsing MIME Message")
-					MIMEBody := &MIMEBody{Parts: make([]*MIMEPart, 0)}
-
-					if err := ParseMIME(MIMEBody, rm.Body, p["boundary"], msg); err == nil {
-						log.LogTrace("Got multiparts %d", len(MIMEBody.Parts))
-						msg.MIME = MIMEBody
-					}
-				} else {
-					setMailBody(rm, msg)
-				}
-			} else {
-				setMailBody(rm, msg)
-			}
-		} else {
-			msg.Content.TextBody = m.Data
-		}
+		parseContent(msg, m.Data)
 	} else {
 		msg.Content = ContentFromString(m.Data)
 	}
@@ -137,9 +126,111 @@ func ParseSMTPMessage(m *config.SMTPMessage, hostname string, mimeParser bool) *
 	msg.Content.Headers["Message-ID"] = []string{msg.Id + "@" + hostname}
 	msg.Content.Headers["Received"] = []string{recd}
 	msg.Content.Headers["Return-Path"] = []string{"<" + m.From + ">"}
+
+	// Keep the original bytes, trace headers go on top: Return-Path is added
+	// at final delivery above the Received line of this hop (RFC 5321 4.4)
+	msg.Raw = "Return-Path: <" + m.From + ">\r\n" + "Received: " + recd + m.Data
 	return msg
 }
 
+// ParseRawMessage parses a message stored in RFC 5322 form, trace headers
+// included, as written by the file based storage backends. Attachments get
+// ids derived from the message id so they can be found again.
+func ParseRawMessage(id string, raw string) *Message {
+	msg := &Message{
+		Id:      id,
+		To:      make([]*Path, 0),
+		Created: time.Now(),
+		Raw:     raw,
+		Unread:  true,
+	}
+
+	parseContent(msg, raw)
+	msg.From = PathFromString("")
+
+	// Envelope sender from the trace header, header sender otherwise
+	if rp := msg.Content.Headers["Return-Path"]; len(rp) > 0 {
+		msg.From = PathFromString(strings.Trim(rp[0], "<> "))
+	} else if addr, err := mail.ParseAddress(mail.Header(msg.Content.Headers).Get("From")); err == nil {
+		msg.From = PathFromString(addr.Address)
+	}
+
+	for i, a := range msg.Attachments {
+		a.Id = fmt.Sprintf("%s%d", id, i)
+	}
+
+	return msg
+}
+
+// parseContent fills in the content, subject, MIME parts and attachments
+// of msg from the message data
+func parseContent(msg *Message, data string) {
+	msg.Content = &Content{Size: len(data), Headers: make(map[string][]string, 0), Body: data}
+
+	// Read mail using standard mail package
+	if rm, err := mail.ReadMessage(bytes.NewBufferString(data)); err == nil {
+		log.LogTrace("Reading Mail Message")
+		msg.Content.Size = len(data)
+		msg.Content.Headers = rm.Header
+		msg.Subject = MimeHeaderDecode(rm.Header.Get("Subject"))
+
+		if mt, p, err := mime.ParseMediaType(rm.Header.Get("Content-Type")); err == nil {
+			if strings.HasPrefix(mt, "multipart/") {
+				log.LogTrace("Parsing MIME Message")
+				MIMEBody := &MIMEBody{Parts: make([]*MIMEPart, 0)}
+
+				if err := ParseMIME(MIMEBody, rm.Body, p["boundary"], msg); err == nil {
+					log.LogTrace("Got multiparts %d", len(MIMEBody.Parts))
+					msg.MIME = MIMEBody
+				}
+			} else {
+				setMailBody(rm, msg)
+			}
+		} else {
+			setMailBody(rm, msg)
+		}
+	} else {
+		msg.Content.TextBody = data
+	}
+}
+
+// RawMessage returns the message in RFC 5322 form as delivered, with the
+// Return-Path and Received trace headers in front and CRLF line endings.
+// Messages stored without the raw copy are rebuilt from the parsed content.
+func (m *Message) RawMessage() string {
+	if m.Raw != "" {
+		return normalizeCRLF(m.Raw)
+	}
+
+	if m.Content == nil {
+		return ""
+	}
+
+	buf := new(bytes.Buffer)
+
+	for _, h := range []string{"Return-Path", "Received"} {
+		for _, v := range m.Content.Headers[h] {
+			buf.WriteString(h + ": " + strings.TrimRight(v, "\r\n") + "\r\n")
+		}
+	}
+
+	buf.WriteString(m.Content.Body)
+	return normalizeCRLF(buf.String())
+}
+
+// normalizeCRLF turns bare LF line endings into CRLF and makes sure the text
+// ends with a line break.
+func normalizeCRLF(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\n", "\r\n", -1)
+
+	if !strings.HasSuffix(s, "\r\n") {
+		s += "\r\n"
+	}
+
+	return s
+}
+
 // db.messages.find({ to:{ $elemMatch: { mailbox:"bob" } } })
 // db.messages.find( { 'from.mailbox': "alex" } )
 func PathFromString(path string) *Path {
@@ -2,7 +2,9 @@ package data
 
 import (
 	"fmt"
+	"io"
 	"strings"
+	"time"
 
 	"github.com/fitraditya/surelin-smtpd/config"
 	"github.com/fitraditya/surelin-smtpd/log"
@@ -12,13 +14,17 @@ import (
 )
 
 type MongoDB struct {
-	Config   config.DataStoreConfig
-	Session  *mgo.Session
-	Messages *mgo.Collection
-	Users    *mgo.Collection
-	Hosts    *mgo.Collection
-	Emails   *mgo.Collection
-	Spamdb   *mgo.Collection
+	Config    config.DataStoreConfig
+	Session   *mgo.Session
+	Messages  *mgo.Collection
+	Mailboxes *mgo.Collection
+	Users     *mgo.Collection
+	Hosts     *mgo.Collection
+	Emails    *mgo.Collection
+	Spamdb    *mgo.Collection
+	Domains   *mgo.Collection
+	Aliases   *mgo.Collection
+	Queue     *mgo.Collection
 }
 
 var (
@@ -48,12 +54,113 @@ func CreateMongoDB(c config.DataStoreConfig) *MongoDB {
 		return nil
 	}
 
-	return &MongoDB{
-		Config:   c,
-		Session:  session,
-		Messages: session.DB(c.MongoDb).C(c.MongoColl),
-		Users:    session.DB(c.MongoDb).C("Users"),
-		Spamdb:   session.DB(c.MongoDb).C("SpamDB"),
+	mongo := &MongoDB{
+		Config:    c,
+		Session:   session,
+		Messages:  session.DB(c.MongoDb).C(c.MongoColl),
+		Mailboxes: session.DB(c.MongoDb).C("Mailboxes"),
+		Users:     session.DB(c.MongoDb).C("Users"),
+		Spamdb:    session.DB(c.MongoDb).C("SpamDB"),
+		Domains:   session.DB(c.MongoDb).C("Domains"),
+		Aliases:   session.DB(c.MongoDb).C("Aliases"),
+		Queue:     session.DB(c.MongoDb).C("Queue"),
+	}
+
+	mongo.migrateMailboxes()
+	mongo.migrateAddressCase()
+	return mongo
+}
+
+// migrateMailboxes gives the messages stored before the Mailboxes collection
+// an entry for every recipient in their "to" field, which is then removed so
+// this runs once. The first entry keeps the id of the message, so for that
+// recipient the POP3 UIDL and the web address do not change.
+func (mongo *MongoDB) migrateMailboxes() {
+	iter := mongo.Messages.Find(bson.M{"to.0": bson.M{"$exists": true}}).Iter()
+	m := Message{}
+	n := 0
+
+	for iter.Next(&m) {
+		if err := mongo.migrateMessage(&m); err != nil {
+			log.LogError("Error creating mailbox entries for message %s: %s", m.Id, err)
+		} else {
+			n++
+		}
+
+		m = Message{}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.LogError("Error migrating messages to mailboxes: %s", err)
+	}
+
+	if n > 0 {
+		log.LogInfo("Created mailbox entries for %d stored messages", n)
+	}
+}
+
+func (mongo *MongoDB) migrateMessage(m *Message) error {
+	// Entries left by an interrupted migration are not added twice
+	n, err := mongo.Mailboxes.Find(bson.M{"messageid": m.Id}).Count()
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		entries := make([]interface{}, 0, len(m.To))
+
+		for i, e := range NewMailboxEntries(m) {
+			if i == 0 {
+				e.Id = m.Id
+			}
+
+			e.Unread = m.Unread
+			e.Starred = m.Starred
+			entries = append(entries, e)
+		}
+
+		if len(entries) > 0 {
+			if err := mongo.Mailboxes.Insert(entries...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return mongo.Messages.Update(bson.M{"id": m.Id}, bson.M{"$unset": bson.M{"to": 1}})
+}
+
+// migrateAddressCase puts the addresses of the users and mailbox entries
+// stored before addresses were normalized in lower case, they are looked up
+// that way
+func (mongo *MongoDB) migrateAddressCase() {
+	upper := bson.M{"$regex": "[A-Z]"}
+	u := User{}
+	iter := mongo.Users.Find(bson.M{"email": upper}).Iter()
+
+	for iter.Next(&u) {
+		if err := mongo.Users.UpdateId(u.Id, bson.M{"$set": bson.M{"email": NormalizeEmail(u.Email)}}); err != nil {
+			log.LogError("Error normalizing the address of user %s: %s", u.Email, err)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.LogError("Error normalizing user addresses: %s", err)
+	}
+
+	e := MailboxEntry{}
+	iter = mongo.Mailboxes.Find(bson.M{"$or": []bson.M{{"mailbox": upper}, {"domain": upper}}}).Iter()
+
+	for iter.Next(&e) {
+		set := bson.M{"mailbox": strings.ToLower(e.Mailbox), "domain": strings.ToLower(e.Domain)}
+
+		if err := mongo.Mailboxes.Update(bson.M{"id": e.Id}, bson.M{"$set": set}); err != nil {
+			log.LogError("Error normalizing the mailbox of entry %s: %s", e.Id, err)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.LogError("Error normalizing mailbox addresses: %s", err)
 	}
 }
 
@@ -61,8 +168,30 @@ func (mongo *MongoDB) Close() {
 	mongo.Session.Close()
 }
 
+// Store inserts the content of m once and an entry in the Mailboxes
+// collection for every recipient
 func (mongo *MongoDB) Store(m *Message) (string, error) {
-	err := mongo.Messages.Insert(m)
+	content := contentOf(m)
+	err := mongo.Messages.Insert(content)
+
+	// If mongo conection is broken, try to reconnect only once
+	if err == io.EOF {
+		log.LogWarn("Connection error trying to reconnect")
+		mongo.Session.Refresh()
+		err = mongo.Messages.Insert(content)
+	}
+
+	if err == nil {
+		entries := make([]interface{}, 0, len(m.To))
+
+		for _, e := range NewMailboxEntries(m) {
+			entries = append(entries, e)
+		}
+
+		if len(entries) > 0 {
+			err = mongo.Mailboxes.Insert(entries...)
+		}
+	}
 
 	if err != nil {
 		log.LogError("Error inserting message: %s", err)
@@ -75,7 +204,7 @@ func (mongo *MongoDB) Store(m *Message) (string, error) {
 // Login validates and returns a user object if they exist in the database.
 func (mongo *MongoDB) Login(email, password string) (*User, error) {
 	u := &User{}
-	err := mongo.Users.Find(bson.M{"email": email}).One(&u)
+	err := mongo.Users.Find(bson.M{"email": NormalizeEmail(email)}).One(&u)
 
 	if err != nil {
 		log.LogError("Login error: %v", err)
@@ -90,9 +219,60 @@ func (mongo *MongoDB) Login(email, password string) (*User, error) {
 	return u, nil
 }
 
+// LoginCramMD5 validates a CRAM-MD5 digest of challenge and returns the user
+// object on success.
+func (mongo *MongoDB) LoginCramMD5(email, challenge, digest string) (*User, error) {
+	u := &User{}
+	err := mongo.Users.Find(bson.M{"email": NormalizeEmail(email)}).One(&u)
+
+	if err != nil {
+		log.LogError("Login error: %v", err)
+		return nil, err
+	}
+
+	if u.CramSecret == "" {
+		log.LogError("No CRAM-MD5 secret stored for: %s", u.Email)
+		return nil, fmt.Errorf("CRAM-MD5 not available!")
+	}
+
+	if ok := Validate_CramMD5(u.CramSecret, challenge, digest); !ok {
+		log.LogError("Invalid CRAM-MD5 digest: %s", u.Email)
+		return nil, fmt.Errorf("Invalid Password!")
+	}
+
+	return u, nil
+}
+
+func (mongo *MongoDB) LoadUser(id string) (*User, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid user id: %s", id)
+	}
+
+	u := &User{}
+	err := mongo.Users.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (mongo *MongoDB) StoreUser(u *User) error {
+	return mongo.Users.Insert(normalizedUser(u))
+}
+
+func (mongo *MongoDB) UpdateUser(u *User) error {
+	return mongo.Users.UpdateId(u.Id, normalizedUser(u))
+}
+
 func (mongo *MongoDB) IsUserExists(email string) (*User, error) {
 	u := &User{}
-	err := mongo.Users.Find(bson.M{"email": email}).One(&u)
+	err := mongo.Users.Find(bson.M{"email": NormalizeEmail(email)}).One(&u)
+
+	if err == mgo.ErrNotFound {
+		err = ErrNotFound
+	}
 
 	if err != nil {
 		log.LogError("Error finding user: %v", err)
@@ -102,19 +282,17 @@ func (mongo *MongoDB) IsUserExists(email string) (*User, error) {
 	return u, nil
 }
 
-func (mongo *MongoDB) List(start int, limit int) (*Messages, error) {
-	messages := &Messages{}
-	err := mongo.Messages.Find(bson.M{}).Sort("-_id").Skip(start).Limit(limit).Select(bson.M{
+// List returns a page of the messages delivered to email, newest first
+func (mongo *MongoDB) List(email string, start int, limit int) (*Messages, error) {
+	query := mongo.Mailboxes.Find(mailboxQuery(email)).Sort("-_id").Skip(start).Limit(limit)
+	messages, err := mongo.loadEntries(query, bson.M{
 		"id":          1,
 		"from":        1,
-		"to":          1,
 		"attachments": 1,
 		"created":     1,
 		"ip":          1,
 		"subject":     1,
-		"starred":     1,
-		"unread":      1,
-	}).All(messages)
+	})
 
 	if err != nil {
 		log.LogError("Error loading messages: %s", err)
@@ -124,8 +302,8 @@ func (mongo *MongoDB) List(start int, limit int) (*Messages, error) {
 	return messages, nil
 }
 
-func (mongo *MongoDB) Total() (int, error) {
-	total, err := mongo.Messages.Find(bson.M{}).Count()
+func (mongo *MongoDB) Total(email string) (int, error) {
+	total, err := mongo.Mailboxes.Find(mailboxQuery(email)).Count()
 
 	if err != nil {
 		log.LogError("Error loading message: %s", err)
@@ -136,24 +314,42 @@ func (mongo *MongoDB) Total() (int, error) {
 }
 
 func (mongo *MongoDB) Load(id string) (*Message, error) {
+	entry := &MailboxEntry{}
 	result := &Message{}
-	err := mongo.Messages.Find(bson.M{"id": id}).One(&result)
+	err := mongo.Mailboxes.Find(bson.M{"id": id}).One(&entry)
+
+	if err == nil {
+		err = mongo.Messages.Find(bson.M{"id": entry.MessageId}).One(&result)
+	}
 
 	if err != nil {
 		log.LogError("Error loading message: %s", err)
 		return nil, err
 	}
 
-	return result, nil
+	return entry.Message(result), nil
 }
 
-func (mongo *MongoDB) LoadAttachment(id string) (*Message, error) {
+// LoadAttachment returns the message holding the attachment, with only that
+// attachment set, if the message was delivered to email
+func (mongo *MongoDB) LoadAttachment(email string, id string) (*Message, error) {
 	result := &Message{}
 	err := mongo.Messages.Find(bson.M{"attachments.id": id}).Select(bson.M{
 		"id":            1,
 		"attachments.$": 1,
 	}).One(&result)
 
+	if err == nil {
+		var n int
+		query := mailboxQuery(email)
+		query["messageid"] = result.Id
+		n, err = mongo.Mailboxes.Find(query).Count()
+
+		if err == nil && n == 0 {
+			err = ErrNotFound
+		}
+	}
+
 	if err != nil {
 		log.LogError("Error loading attachment: %s", err)
 		return nil, err
@@ -162,10 +358,12 @@ func (mongo *MongoDB) LoadAttachment(id string) (*Message, error) {
 	return result, nil
 }
 
+func (mongo *MongoDB) SetUnread(id string, unread bool) error {
+	return mongo.Mailboxes.Update(bson.M{"id": id}, bson.M{"$set": bson.M{"unread": unread}})
+}
+
 func (mongo *MongoDB) Fetch(email string) (*Messages, error) {
-	s := strings.Split(email, "@")
-	messages := &Messages{}
-	err := mongo.Messages.Find(bson.M{"to": bson.M{"$elemMatch": bson.M{"mailbox": s[0], "domain": s[1]}}}).All(messages)
+	messages, err := mongo.loadEntries(mongo.Mailboxes.Find(mailboxQuery(email)).Sort("_id"), nil)
 
 	if err != nil {
 		log.LogError("Error loading messages: %s", err)
@@ -175,16 +373,162 @@ func (mongo *MongoDB) Fetch(email string) (*Messages, error) {
 	return messages, nil
 }
 
+// DeleteOne removes a message from one mailbox, its content goes with the
+// last copy
 func (mongo *MongoDB) DeleteOne(id string) error {
-	_, err := mongo.Messages.RemoveAll(bson.M{"id": id})
+	entry := &MailboxEntry{}
+	err := mongo.Mailboxes.Find(bson.M{"id": id}).One(&entry)
+
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := mongo.Mailboxes.Remove(bson.M{"id": id}); err != nil {
+		return err
+	}
+
+	n, err := mongo.Mailboxes.Find(bson.M{"messageid": entry.MessageId}).Count()
+
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = mongo.Messages.RemoveAll(bson.M{"id": entry.MessageId})
 	return err
 }
 
 func (mongo *MongoDB) DeleteAll() error {
+	if _, err := mongo.Mailboxes.RemoveAll(bson.M{}); err != nil {
+		return err
+	}
+
 	_, err := mongo.Messages.RemoveAll(bson.M{})
 	return err
 }
 
+func (mongo *MongoDB) ListDomains() ([]Domain, error) {
+	domains := []Domain{}
+	err := mongo.Domains.Find(bson.M{}).Sort("name").All(&domains)
+
+	if err != nil {
+		log.LogError("Error loading domains: %s", err)
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+func (mongo *MongoDB) LoadDomain(name string) (*Domain, error) {
+	d := &Domain{}
+	err := mongo.Domains.Find(bson.M{"name": name}).One(&d)
+
+	if err == mgo.ErrNotFound {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (mongo *MongoDB) StoreDomain(d *Domain) error {
+	_, err := mongo.Domains.Upsert(bson.M{"name": d.Name}, d)
+	return err
+}
+
+func (mongo *MongoDB) DeleteDomain(name string) error {
+	_, err := mongo.Domains.RemoveAll(bson.M{"name": name})
+	return err
+}
+
+func (mongo *MongoDB) ListAliases() ([]Alias, error) {
+	aliases := []Alias{}
+	err := mongo.Aliases.Find(bson.M{}).Sort("address").All(&aliases)
+
+	if err != nil {
+		log.LogError("Error loading aliases: %s", err)
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func (mongo *MongoDB) LoadAlias(address string) (*Alias, error) {
+	a := &Alias{}
+	err := mongo.Aliases.Find(bson.M{"address": address}).One(&a)
+
+	if err == mgo.ErrNotFound {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (mongo *MongoDB) StoreAlias(a *Alias) error {
+	_, err := mongo.Aliases.Upsert(bson.M{"address": a.Address}, a)
+	return err
+}
+
+func (mongo *MongoDB) DeleteAlias(address string) error {
+	_, err := mongo.Aliases.RemoveAll(bson.M{"address": address})
+	return err
+}
+
+// ListQueue returns the queued messages due at or before due, oldest first
+func (mongo *MongoDB) ListQueue(due time.Time) ([]QueuedMessage, error) {
+	queue := []QueuedMessage{}
+	err := mongo.Queue.Find(bson.M{"nextattempt": bson.M{"$lte": due}}).Sort("_id").All(&queue)
+
+	if err != nil {
+		log.LogError("Error loading queue: %s", err)
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+func (mongo *MongoDB) LoadQueued(id string) (*QueuedMessage, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+
+	q := &QueuedMessage{}
+	err := mongo.Queue.FindId(bson.ObjectIdHex(id)).One(&q)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (mongo *MongoDB) StoreQueued(q *QueuedMessage) error {
+	_, err := mongo.Queue.UpsertId(q.Id, q)
+	return err
+}
+
+func (mongo *MongoDB) DeleteQueued(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+
+	return mongo.Queue.RemoveId(bson.ObjectIdHex(id))
+}
+
 func (mongo *MongoDB) StoreSpamIp(s SpamIP) (string, error) {
 	err := mongo.Spamdb.Insert(s)
 	if err != nil {
@@ -193,3 +537,58 @@ func (mongo *MongoDB) StoreSpamIp(s SpamIP) (string, error) {
 	}
 	return s.Id.Hex(), nil
 }
+
+// loadEntries returns the messages of the mailbox entries found by query, in
+// the same order. Only the given fields of the content are loaded if fields
+// is not nil.
+func (mongo *MongoDB) loadEntries(query *mgo.Query, fields bson.M) (*Messages, error) {
+	entries := []MailboxEntry{}
+
+	if err := query.All(&entries); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+
+	for _, e := range entries {
+		ids = append(ids, e.MessageId)
+	}
+
+	contents := []Message{}
+	q := mongo.Messages.Find(bson.M{"id": bson.M{"$in": ids}})
+
+	if fields != nil {
+		q = q.Select(fields)
+	}
+
+	if err := q.All(&contents); err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]*Message, len(contents))
+
+	for i := range contents {
+		byId[contents[i].Id] = &contents[i]
+	}
+
+	messages := Messages{}
+
+	for i := range entries {
+		if m, ok := byId[entries[i].MessageId]; ok {
+			messages = append(messages, *entries[i].Message(m))
+		}
+	}
+
+	return &messages, nil
+}
+
+// mailboxQuery matches the mailbox entries of email
+func mailboxQuery(email string) bson.M {
+	s := strings.SplitN(NormalizeEmail(email), "@", 2)
+
+	if len(s) != 2 {
+		s = append(s, "")
+	}
+
+	return bson.M{"mailbox": s[0], "domain": s[1]}
+}
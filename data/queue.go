@@ -0,0 +1,86 @@
+package data
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Delivery states of a queued recipient
+const (
+	QueuePending = "pending"
+	QueueSent    = "sent"
+	QueueFailed  = "failed"
+)
+
+// QueuedRecipient is a remote recipient of a queued message. Original is the
+// address the message was sent to, it differs from Address when an alias
+// forwarded it. LastError is the reply of the remote server to the last
+// attempt and DsnStatus its RFC 3463 status code. TLS has the parameters
+// negotiated for the last attempt, empty if it was in plaintext.
+type QueuedRecipient struct {
+	Address   string
+	Original  string
+	Status    string
+	LastError string
+	DsnStatus string
+	TLS       string
+}
+
+// QueuedMessage is a message waiting in the outbound queue, it is kept until
+// every recipient is either sent or failed. From is empty for bounces.
+// Warned is set once the sender was told the delivery is delayed.
+type QueuedMessage struct {
+	Id          bson.ObjectId `bson:"_id"`
+	From        string
+	Recipients  []QueuedRecipient
+	Data        string
+	CreatedAt   time.Time
+	NextAttempt time.Time
+	Attempts    int
+	Warned      bool
+}
+
+// NewQueuedMessage returns a message from from, due for delivery right away
+func NewQueuedMessage(from string, data string) *QueuedMessage {
+	now := time.Now()
+
+	return &QueuedMessage{
+		Id:          bson.NewObjectId(),
+		From:        from,
+		Recipients:  make([]QueuedRecipient, 0),
+		Data:        data,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+}
+
+// AddRecipient adds a pending recipient, original is the address the message
+// was sent to before alias expansion
+func (q *QueuedMessage) AddRecipient(address string, original string) {
+	q.Recipients = append(q.Recipients, QueuedRecipient{
+		Address:  address,
+		Original: original,
+		Status:   QueuePending,
+	})
+}
+
+// Pending returns the number of recipients still to be delivered
+func (q *QueuedMessage) Pending() int {
+	n := 0
+
+	for _, r := range q.Recipients {
+		if r.Status == QueuePending {
+			n++
+		}
+	}
+
+	return n
+}
+
+// copyQueued returns a copy of q which shares nothing with it
+func copyQueued(q *QueuedMessage) *QueuedMessage {
+	cp := *q
+	cp.Recipients = append([]QueuedRecipient(nil), q.Recipients...)
+	return &cp
+}
@@ -1,8 +1,9 @@
 package data
 
 import (
-	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/fitraditya/surelin-smtpd/config"
@@ -10,9 +11,62 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+// Storage is implemented by the message store backends, the protocol servers
+// and the web interface only talk to it through this interface
+type Storage interface {
+	Close()
+
+	// Messages. Store keeps the content once and puts a copy in the mailbox
+	// of every recipient in m.To, the other methods take the id of a copy.
+	Store(m *Message) (string, error)
+	Load(id string) (*Message, error)
+	LoadAttachment(email string, id string) (*Message, error)
+	SetUnread(id string, unread bool) error
+	DeleteOne(id string) error
+	DeleteAll() error
+
+	// Mailboxes, messages delivered to email
+	Fetch(email string) (*Messages, error)
+	List(email string, start int, limit int) (*Messages, error)
+	Total(email string) (int, error)
+
+	// Users
+	Login(email, password string) (*User, error)
+	LoginCramMD5(email, challenge, digest string) (*User, error)
+	IsUserExists(email string) (*User, error)
+	LoadUser(id string) (*User, error)
+	StoreUser(u *User) error
+	UpdateUser(u *User) error
+
+	// Hosted domains, names are lower case
+	ListDomains() ([]Domain, error)
+	LoadDomain(name string) (*Domain, error)
+	StoreDomain(d *Domain) error // Adds or replaces d
+	DeleteDomain(name string) error
+
+	// Aliases, addresses are lower case
+	ListAliases() ([]Alias, error)
+	LoadAlias(address string) (*Alias, error)
+	StoreAlias(a *Alias) error
+	DeleteAlias(address string) error
+
+	// Outbound queue. ListQueue returns the messages due for delivery at or
+	// before due, oldest first.
+	ListQueue(due time.Time) ([]QueuedMessage, error)
+	LoadQueued(id string) (*QueuedMessage, error)
+	StoreQueued(q *QueuedMessage) error // Adds or replaces q
+	DeleteQueued(id string) error
+
+	// Spam records
+	StoreSpamIp(s SpamIP) (string, error)
+}
+
+// ErrNotFound is returned by the storage backends when a lookup has no result
+var ErrNotFound = errors.New("not found")
+
 type DataStore struct {
 	Config       config.DataStoreConfig
-	Storage      interface{}
+	Storage      Storage
 	SaveMailChan chan *config.SMTPMessage
 }
 
@@ -27,7 +81,11 @@ func NewDataStore() *DataStore {
 }
 
 func (ds *DataStore) StorageConnect() {
-	if ds.Config.Storage == "mongodb" {
+	switch ds.Config.Storage {
+	case "memory":
+		log.LogInfo("Using memory storage, messages are lost on restart")
+		ds.Storage = CreateMemoryStore(ds.Config)
+	case "mongodb":
 		log.LogInfo("Trying MongoDB storage")
 		s := CreateMongoDB(ds.Config)
 
@@ -37,7 +95,29 @@ func (ds *DataStore) StorageConnect() {
 			log.LogInfo("Using MongoDB storage")
 			ds.Storage = s
 		}
+	case "maildir":
+		s := CreateMaildirStore(ds.Config)
+
+		if s == nil {
+			log.LogInfo("Maildir storage unavailable")
+		} else {
+			log.LogInfo("Using Maildir storage in %s", ds.Config.MaildirPath)
+			ds.Storage = s
+		}
+	case "bolt":
+		s := CreateBoltDB(ds.Config)
+
+		if s == nil {
+			log.LogInfo("BoltDB storage unavailable")
+		} else {
+			log.LogInfo("Using BoltDB storage in %s", ds.Config.BoltPath)
+			ds.Storage = s
+		}
+	default:
+		log.LogError("Unknown storage: %s", ds.Config.Storage)
+	}
 
+	if ds.Storage != nil {
 		// Start some savemail workers
 		for i := 0; i < 3; i++ {
 			go ds.SaveMail(i)
@@ -46,16 +126,16 @@ func (ds *DataStore) StorageConnect() {
 }
 
 func (ds *DataStore) StorageDisconnect() {
-	if ds.Config.Storage == "mongodb" {
-		ds.Storage.(*MongoDB).Close()
+	if ds.Storage != nil {
+		ds.Storage.Close()
 	}
 }
 
 func (ds *DataStore) CheckUserExists(email string) bool {
-	user, err := ds.Storage.(*MongoDB).IsUserExists(email)
+	user, err := ds.Storage.IsUserExists(email)
 
 	if err != nil {
-		return true
+		return false
 	}
 
 	if user != nil {
@@ -65,8 +145,42 @@ func (ds *DataStore) CheckUserExists(email string) bool {
 	return false
 }
 
+// ValidRecipient returns true if mail for the local address email can be
+// delivered. An error means the user store could not be asked.
+func (ds *DataStore) ValidRecipient(email string) (bool, error) {
+	if ds.Storage == nil {
+		return false, errors.New("No storage available")
+	}
+
+	_, err := ds.Storage.IsUserExists(email)
+
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (ds *DataStore) LoginUser(email string, password string) bool {
-	user, err := ds.Storage.(*MongoDB).Login(email, password)
+	user, err := ds.Storage.Login(email, password)
+
+	if err != nil {
+		return false
+	}
+
+	if user != nil {
+		return true
+	}
+
+	return false
+}
+
+func (ds *DataStore) LoginCramMD5(email string, challenge string, digest string) bool {
+	user, err := ds.Storage.LoginCramMD5(email, challenge, digest)
 
 	if err != nil {
 		return false
@@ -82,63 +196,26 @@ func (ds *DataStore) LoginUser(email string, password string) bool {
 func (ds *DataStore) SaveMail(id int) {
 	log.LogTrace("Running Save Mail Daemon #<%d>", id)
 	var err error
-	var recon bool
 
 	for {
 		mc := <-ds.SaveMailChan
 		msg := ParseSMTPMessage(mc, mc.Domain, true)
+		mc.Hash, err = ds.Storage.Store(msg)
 
-		if ds.Config.Storage == "mongodb" {
-			mc.Hash, err = ds.Storage.(*MongoDB).Store(msg)
-
-			// If mongo conection is broken, try to reconnect only once
-			if err == io.EOF && !recon {
-				log.LogWarn("Connection error trying to reconnect")
-				ds.Storage = CreateMongoDB(ds.Config)
-				recon = true
-
-				// Try to save again
-				mc.Hash, err = ds.Storage.(*MongoDB).Store(msg)
-			}
-
-			if err == nil {
-				recon = false
-				log.LogTrace("Save Mail Client hash : <%s>", mc.Hash)
-				mc.Notify <- 1
-			} else {
-				mc.Notify <- -1
-				log.LogError("Error storing message: %s", err)
-			}
-		}
-	}
-}
-
-func (ds *DataStore) StatMails(email string) (nr int, size int) {
-	messages, err := ds.Storage.(*MongoDB).Fetch(email)
-
-	if err != nil {
-		return 0, 0
-	}
-
-	var sum = 0
-
-	// Count how many letters there are in all the headers and messages
-	for _, m := range *messages {
-		for _, c := range m.Content.Headers {
-			for _, h := range c {
-				sum = sum + len(h)
-			}
+		if err == nil {
+			log.LogTrace("Save Mail Client hash : <%s>", mc.Hash)
+			mc.Notify <- 1
+		} else {
+			mc.Notify <- -1
+			log.LogError("Error storing message: %s", err)
 		}
-
-		sum = sum + len(m.Content.Body)
 	}
-
-	// Return the count and the size in octets (bytes)
-	return len(*messages), sum * 8
 }
 
+// ListMails returns a snapshot of the maildrop of email, numbered from 1 in
+// storage order
 func (ds *DataStore) ListMails(email string) (nr int, size int, head []MessageHead) {
-	messages, err := ds.Storage.(*MongoDB).Fetch(email)
+	messages, err := ds.Storage.Fetch(email)
 
 	if err != nil {
 		return 0, 0, nil
@@ -147,86 +224,139 @@ func (ds *DataStore) ListMails(email string) (nr int, size int, head []MessageHe
 	var sum = 0
 	var heads []MessageHead
 
-	// Count how many letters there are in all the headers and messages
 	for i, m := range *messages {
-		sz := 0
-
-		for _, c := range m.Content.Headers {
-			for _, h := range c {
-				sz = sz + len(h)
-			}
-		}
-
-		size_ := sz
-		sz = sz + len(m.Content.Body)*8
+		sz := len(m.RawMessage())
 		mh := MessageHead{
 			Id:   i + 1,
 			Uid:  m.Id,
 			Size: sz,
 		}
 		heads = append(heads, mh)
-		sum = sum + size_ + len(m.Content.Body)
+		sum = sum + sz
 	}
 
 	// Return the count and the size in octets (bytes)
-	return len(heads), sum * 8, heads
+	return len(heads), sum, heads
 }
 
-func (ds *DataStore) GetMail(email string, id int) (message Message, size int) {
-	messages, err := ds.Storage.(*MongoDB).Fetch(email)
+// GetMail returns a message of the maildrop of email in RFC 5322 form
+func (ds *DataStore) GetMail(email string, uid string) (string, error) {
+	m, err := ds.Storage.Load(uid)
 
 	if err != nil {
-		return Message{}, 0
+		log.LogError("Error loading message <%s> of <%s>: %s", uid, email, err)
+		return "", err
 	}
 
-	// Get the specified message
-	i := id - 1
-	m := (*messages)[i]
-	sz := 0
+	return m.RawMessage(), nil
+}
 
-	for _, c := range m.Content.Headers {
-		for _, h := range c {
-			sz = sz + len(h)
-		}
+// DeleteMail removes a message from the maildrop of email
+func (ds *DataStore) DeleteMail(email string, uid string) bool {
+	if err := ds.Storage.DeleteOne(uid); err != nil {
+		log.LogError("Error deleting message <%s> of <%s>: %s", uid, email, err)
+		return false
 	}
 
-	sz = sz + len(m.Content.Body)*8
-	return m, sz
+	return true
 }
 
-func (ds *DataStore) DeleteMail(email string, id int) bool {
-	messages, err := ds.Storage.(*MongoDB).Fetch(email)
+// TopMail returns the headers of a message of the maildrop of email, the
+// blank separator line and the first lines of its body
+func (ds *DataStore) TopMail(email string, uid string, lines int) (string, error) {
+	raw, err := ds.GetMail(email, uid)
 
 	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(raw, "\r\n\r\n", 2)
+
+	if len(parts) < 2 {
+		return raw, nil
+	}
+
+	body := strings.SplitAfter(parts[1], "\r\n")
+
+	if lines < len(body) {
+		body = body[:lines]
+	}
+
+	return parts[0] + "\r\n\r\n" + strings.Join(body, ""), nil
+}
+
+// IsLocalDomain returns true if mail for domain is delivered locally, it has
+// to be the exact name of an active hosted domain
+func (ds *DataStore) IsLocalDomain(domain string) bool {
+	if ds.Storage == nil {
 		return false
 	}
 
-	// Get the specified message
-	i := id - 1
-	m := (*messages)[i]
-	sz := 0
+	d, err := ds.Storage.LoadDomain(strings.ToLower(domain))
+	return err == nil && d.IsActive
+}
 
-	for _, c := range m.Content.Headers {
-		for _, h := range c {
-			sz = sz + len(h)
-		}
+// AddDomain adds name to the hosted domains, nothing is done if it is hosted
+// already
+func (ds *DataStore) AddDomain(name string) error {
+	d := NewDomain(name)
+
+	if d.Name == "" || strings.ContainsAny(d.Name, "@/\\ ") {
+		return fmt.Errorf("Invalid domain name: %q", name)
 	}
 
-	sz = sz + len(m.Content.Body)*8
-	return true
+	if _, err := ds.Storage.LoadDomain(d.Name); err == nil {
+		return nil
+	}
+
+	log.LogInfo("Hosting domain %s", d.Name)
+	return ds.Storage.StoreDomain(d)
+}
+
+// DeleteDomain stops hosting name
+func (ds *DataStore) DeleteDomain(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	log.LogInfo("No longer hosting domain %s", name)
+	return ds.Storage.DeleteDomain(name)
 }
 
-func (ds *DataStore) TopMail(email string, id int) (headers string) {
-	messages, err := ds.Storage.(*MongoDB).Fetch(email)
+// SetPlusAddressing turns plus addressing of the hosted domain name on or off
+func (ds *DataStore) SetPlusAddressing(name string, on bool) error {
+	d, err := ds.Storage.LoadDomain(strings.ToLower(strings.TrimSpace(name)))
 
 	if err != nil {
-		return ""
+		return err
 	}
 
-	out, err := json.Marshal((*messages)[id-1].Content.Headers)
+	d.PlusAddressing = on
+	return ds.Storage.StoreDomain(d)
+}
+
+// AddAlias adds or replaces the alias of address to targets, address is a
+// local address or "@domain" for the catch-all of a hosted domain
+func (ds *DataStore) AddAlias(address string, targets []string) error {
+	a := NewAlias(address, targets)
+
+	if !ds.IsLocalDomain(DomainOf(a.Address)) {
+		return fmt.Errorf("Not a hosted domain: %q", address)
+	}
+
+	if len(a.Targets) == 0 {
+		return fmt.Errorf("No targets for alias %q", address)
+	}
+
+	for _, t := range a.Targets {
+		if !strings.Contains(t, "@") {
+			return fmt.Errorf("Invalid alias target: %q", t)
+		}
+	}
+
+	return ds.Storage.StoreAlias(a)
+}
 
-	// Get the specified message
-	return string(out)
+// DeleteAlias removes the alias of address
+func (ds *DataStore) DeleteAlias(address string) error {
+	return ds.Storage.DeleteAlias(strings.ToLower(strings.TrimSpace(address)))
 }
 
 func (ds *DataStore) SaveSpamIP(ip string, email string) {
@@ -238,7 +368,7 @@ func (ds *DataStore) SaveSpamIP(ip string, email string) {
 		IPAddress: ip,
 	}
 
-	if _, err := ds.Storage.(*MongoDB).StoreSpamIp(s); err != nil {
+	if _, err := ds.Storage.StoreSpamIp(s); err != nil {
 		log.LogError("Error inserting Spam IPAddress: %s", err)
 	}
 }
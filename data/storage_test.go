@@ -0,0 +1,355 @@
+package data
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A message with one attachment, for the backends which parse the raw data
+const testRaw = "From: carol@remote.org\r\n" +
+	"To: alice@example.com, bob@example.com\r\n" +
+	"Subject: Contract\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"note.txt\"\r\n" +
+	"\r\n" +
+	"Attached\r\n" +
+	"--b1--\r\n"
+
+// testBackends returns every backend which runs without a server, empty
+func testBackends(t *testing.T) map[string]Storage {
+	dir := t.TempDir()
+	bdb := CreateBoltDB(config.DataStoreConfig{BoltPath: filepath.Join(dir, "surelin.db")})
+	mdir := CreateMaildirStore(config.DataStoreConfig{MaildirPath: filepath.Join(dir, "maildir")})
+
+	if bdb == nil || mdir == nil {
+		t.Fatal("Cannot open the storage backends")
+	}
+
+	t.Cleanup(bdb.Close)
+
+	return map[string]Storage{
+		"memory":  CreateMemoryStore(config.DataStoreConfig{}),
+		"bolt":    bdb,
+		"maildir": mdir,
+	}
+}
+
+// contentCount returns the number of message contents kept by s
+func contentCount(t *testing.T, s Storage) int {
+	switch s := s.(type) {
+	case *MemoryStore:
+		return len(s.messages)
+	case *BoltDB:
+		n := 0
+
+		s.DB.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(boltMessages).Stats().KeyN
+			return nil
+		})
+
+		return n
+	case *MaildirStore:
+		// Copies are hard links, the content goes with the last one
+		files, err := s.allFiles()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(files)
+	}
+
+	t.Fatalf("Unknown backend %T", s)
+	return 0
+}
+
+func TestStorageMessages(t *testing.T) {
+	for name, s := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"alice@example.com", "bob@example.com", "dave@example.com"} {
+				if err := s.StoreUser(&User{Id: bson.NewObjectId(), Email: email, IsActive: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := ParseRawMessage(bson.NewObjectId().Hex(), testRaw)
+			m.To = []*Path{PathFromString("alice@example.com"), PathFromString("bob@example.com")}
+
+			if len(m.Attachments) != 1 {
+				t.Fatalf("Test message has %d attachments, want 1", len(m.Attachments))
+			}
+
+			if _, err := s.Store(m); err != nil {
+				t.Fatal(err)
+			}
+
+			copies := make(map[string]string)
+
+			for _, email := range []string{"alice@example.com", "bob@example.com"} {
+				messages, err := s.Fetch(email)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(*messages) != 1 {
+					t.Fatalf("Fetch(%s) returned %d messages, want 1", email, len(*messages))
+				}
+
+				copies[email] = (*messages)[0].Id
+			}
+
+			if copies["alice@example.com"] == copies["bob@example.com"] {
+				t.Fatal("Recipients share the id of their copy")
+			}
+
+			// A copy shows its own mailbox only, not the other recipients
+			loaded, err := s.Load(copies["alice@example.com"])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if loaded.Subject != "Contract" || len(loaded.To) != 1 || loaded.To[0].Mailbox != "alice" {
+				t.Errorf("Load returned subject %q to %v", loaded.Subject, loaded.To)
+			}
+
+			// Attachment ids as the copy has them, backends may number them
+			// by copy
+			if len(loaded.Attachments) != 1 {
+				t.Fatalf("Load returned %d attachments, want 1", len(loaded.Attachments))
+			}
+
+			attachment := loaded.Attachments[0].Id
+
+			if _, err := s.LoadAttachment("alice@example.com", attachment); err != nil {
+				t.Errorf("LoadAttachment for a recipient failed: %s", err)
+			}
+
+			if _, err := s.LoadAttachment("dave@example.com", attachment); err == nil {
+				t.Error("LoadAttachment returned the attachment to another mailbox")
+			}
+
+			// The content stays until the last copy is deleted
+			if err := s.DeleteOne(copies["alice@example.com"]); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, _ := s.Total("alice@example.com"); n != 0 {
+				t.Errorf("Total after DeleteOne is %d, want 0", n)
+			}
+
+			other, err := s.Load(copies["bob@example.com"])
+
+			if err != nil {
+				t.Fatalf("Other copy gone after DeleteOne: %s", err)
+			}
+
+			attachment = other.Attachments[0].Id
+
+			if _, err := s.LoadAttachment("bob@example.com", attachment); err != nil {
+				t.Errorf("LoadAttachment for the other copy failed: %s", err)
+			}
+
+			if n := contentCount(t, s); n == 0 {
+				t.Error("Content removed with a copy left")
+			}
+
+			if err := s.DeleteOne(copies["bob@example.com"]); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := contentCount(t, s); n != 0 {
+				t.Errorf("Content kept after the last copy was deleted: %d left", n)
+			}
+
+			if _, err := s.LoadAttachment("bob@example.com", attachment); err == nil {
+				t.Error("Attachment still loads after the last copy was deleted")
+			}
+		})
+	}
+}
+
+func TestStorageQueue(t *testing.T) {
+	for name, s := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			due := NewQueuedMessage("alice@example.com", "Subject: due\r\n\r\nhi\r\n")
+			due.AddRecipient("bob@remote.org", "bob@remote.org")
+			due.NextAttempt = now.Add(-time.Minute)
+
+			later := NewQueuedMessage("", "Subject: later\r\n\r\nhi\r\n")
+			later.AddRecipient("carol@remote.org", "info@example.com")
+			later.NextAttempt = now.Add(time.Hour)
+
+			for _, q := range []*QueuedMessage{due, later} {
+				if err := s.StoreQueued(q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			queue, err := s.ListQueue(now)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(queue) != 1 || queue[0].Id != due.Id {
+				t.Fatalf("ListQueue returned %d messages, want only the due one", len(queue))
+			}
+
+			// Replaced in place, not added
+			later.Recipients[0].Status = QueueFailed
+			later.Recipients[0].LastError = "550 5.1.1 User unknown"
+			later.Attempts = 2
+
+			if err := s.StoreQueued(later); err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := s.LoadQueued(later.Id.Hex())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := q.Recipients[0]
+
+			if q.From != "" || q.Attempts != 2 || r.Original != "info@example.com" || r.Status != QueueFailed || r.LastError != "550 5.1.1 User unknown" {
+				t.Errorf("LoadQueued returned %+v", q)
+			}
+
+			if queue, _ := s.ListQueue(now.Add(2 * time.Hour)); len(queue) != 2 {
+				t.Errorf("ListQueue returned %d messages, want 2", len(queue))
+			}
+
+			if err := s.DeleteQueued(due.Id.Hex()); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.LoadQueued(due.Id.Hex()); err == nil {
+				t.Error("LoadQueued returned a deleted message")
+			}
+		})
+	}
+}
+
+func TestMaildirStore(t *testing.T) {
+	cfg := config.DataStoreConfig{MaildirPath: filepath.Join(t.TempDir(), "maildir")}
+	mdir := CreateMaildirStore(cfg)
+
+	if err := mdir.StoreUser(&User{Id: bson.NewObjectId(), Email: "alice@example.com", IsActive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// All or nothing, the caller bounces the message
+	m := ParseRawMessage(bson.NewObjectId().Hex(), testRaw)
+	m.To = []*Path{PathFromString("alice@example.com"), PathFromString("bob@example.com")}
+
+	if _, err := mdir.Store(m); err == nil {
+		t.Error("Store succeeded with a recipient without account")
+	}
+
+	if n, _ := mdir.Total("alice@example.com"); n != 0 {
+		t.Errorf("Store delivered %d copies with a recipient without account", n)
+	}
+
+	m.To = m.To[:1]
+
+	if _, err := mdir.Store(m); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := mdir.Fetch("alice@example.com")
+
+	if err != nil || len(*messages) != 1 {
+		t.Fatalf("Fetch returned %v, %v", messages, err)
+	}
+
+	id := (*messages)[0].Id
+
+	// Ids are resolved from the index built when the store is opened
+	mdir = CreateMaildirStore(cfg)
+
+	if err := mdir.SetUnread(id, false); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := mdir.Load(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Unread {
+		t.Error("Message still unread after SetUnread")
+	}
+
+	if err := mdir.DeleteOne(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mdir.Load(id); err != ErrNotFound {
+		t.Errorf("Load after DeleteOne returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestStorageAddressCase(t *testing.T) {
+	for name, s := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.StoreUser(&User{Id: bson.NewObjectId(), Email: "Alice@Example.com", IsActive: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.IsUserExists("alice@EXAMPLE.com"); err != nil {
+				t.Fatalf("IsUserExists in another case failed: %s", err)
+			}
+
+			m := ParseRawMessage(bson.NewObjectId().Hex(), testRaw)
+			m.To = []*Path{PathFromString("ALICE@example.com")}
+
+			if _, err := s.Store(m); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, email := range []string{"alice@example.com", "Alice@Example.com"} {
+				messages, err := s.Fetch(email)
+
+				if err != nil || len(*messages) != 1 {
+					t.Fatalf("Fetch(%s) returned %v, %v", email, messages, err)
+				}
+
+				if n, _ := s.Total(email); n != 1 {
+					t.Errorf("Total(%s) is %d, want 1", email, n)
+				}
+
+				if list, err := s.List(email, 0, 10); err != nil || len(*list) != 1 {
+					t.Errorf("List(%s) returned %v, %v", email, list, err)
+				}
+
+				loaded := (*messages)[0]
+
+				if !loaded.IsDeliveredTo(email) {
+					t.Errorf("IsDeliveredTo(%s) is false", email)
+				}
+
+				if _, err := s.LoadAttachment(email, loaded.Attachments[0].Id); err != nil {
+					t.Errorf("LoadAttachment(%s) failed: %s", email, err)
+				}
+			}
+		})
+	}
+}
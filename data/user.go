@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding"
 	"encoding/hex"
 	"regexp"
 	"strings"
@@ -18,7 +19,9 @@ type User struct {
 	Firstname     string
 	Lastname      string
 	Email         string
+	Domain        string
 	Password      string
+	CramSecret    string
 	Avatar        string
 	Website       string
 	Location      string
@@ -34,6 +37,14 @@ type User struct {
 	LoginCount    int64
 }
 
+// normalizedUser returns a copy of u with its address normalized, the copy is
+// what the backends store
+func normalizedUser(u *User) *User {
+	cp := *u
+	cp.Email = NormalizeEmail(u.Email)
+	return &cp
+}
+
 type LoginForm struct {
 	Email    string
 	Password string
@@ -95,8 +106,80 @@ func Validate_Password(hashed string, input_password string) bool {
 	return false
 }
 
+// Encrypt_CramMD5 precomputes the HMAC-MD5 inner and outer digest states for
+// the password, so CRAM-MD5 responses can be checked without storing it in
+// clear text.
+func Encrypt_CramMD5(password string) string {
+	key := []byte(password)
+
+	if len(key) > 64 {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+
+	ipad := make([]byte, 64)
+	opad := make([]byte, 64)
+	copy(ipad, key)
+	copy(opad, key)
+
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+
+	inner := md5.New()
+	inner.Write(ipad)
+	outer := md5.New()
+	outer.Write(opad)
+
+	innerState, _ := inner.(encoding.BinaryMarshaler).MarshalBinary()
+	outerState, _ := outer.(encoding.BinaryMarshaler).MarshalBinary()
+
+	return hex.EncodeToString(innerState) + ":" + hex.EncodeToString(outerState)
+}
+
+// Validate_CramMD5 checks a CRAM-MD5 digest of the challenge against the
+// secret produced by Encrypt_CramMD5.
+func Validate_CramMD5(secret string, challenge string, digest string) bool {
+	parts := strings.SplitN(secret, ":", 2)
+
+	if len(parts) != 2 {
+		return false
+	}
+
+	innerState, err := hex.DecodeString(parts[0])
+
+	if err != nil {
+		return false
+	}
+
+	outerState, err := hex.DecodeString(parts[1])
+
+	if err != nil {
+		return false
+	}
+
+	inner := md5.New()
+	outer := md5.New()
+
+	if err := inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(innerState); err != nil {
+		return false
+	}
+
+	if err := outer.(encoding.BinaryUnmarshaler).UnmarshalBinary(outerState); err != nil {
+		return false
+	}
+
+	inner.Write([]byte(challenge))
+	outer.Write(inner.Sum(nil))
+	expected := hex.EncodeToString(outer.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(digest)))
+}
+
 // SetPassword takes a plaintext password and hashes it with bcrypt and sets the
 // password field to the hash.
 func (u *User) SetPassword(password string) {
 	u.Password = Encrypt_Password(password, nil)
+	u.CramSecret = Encrypt_CramMD5(password)
 }
@@ -121,6 +121,13 @@ func main() {
 	ds = data.NewDataStore()
 	ds.StorageConnect()
 
+	// The domain of the SMTP server is always hosted
+	if ds.Storage != nil {
+		if err := ds.AddDomain(config.GetSmtpConfig().Domain); err != nil {
+			log.LogError("Failed to add hosted domain: %v", err)
+		}
+	}
+
 	// Start mailer daemon
 	md = smtpd.NewMailer(ds)
 	md.Start()
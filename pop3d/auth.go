@@ -0,0 +1,169 @@
+package pop3d
+
+import (
+  "encoding/base64"
+  "errors"
+  "strings"
+
+  "github.com/fitraditya/surelin-smtpd/data"
+)
+
+var (
+  errAuthCancelled = errors.New("Authentication cancelled")
+  errAuthInvalid   = errors.New("Authentication credentials invalid")
+)
+
+// mechanisms returns the SASL mechanisms available on the connection,
+// CRAM-MD5 only if enabled as accounts need a secret for it
+func (c *Client) mechanisms() []string {
+  mechanisms := make([]string, 0, 2)
+
+  if c.plainAllowed() {
+    mechanisms = append(mechanisms, "PLAIN")
+  }
+
+  if c.server.cramMD5 {
+    mechanisms = append(mechanisms, "CRAM-MD5")
+  }
+
+  return mechanisms
+}
+
+// AUTH command (RFC 5034), without argument the mechanisms are listed
+func (c *Client) authHandler(args []string) {
+  if len(args) == 0 {
+    c.Write("+OK")
+
+    for _, m := range c.mechanisms() {
+      c.Write(m)
+    }
+
+    c.Write(".")
+    return
+  }
+
+  mechanism := strings.ToUpper(args[0])
+  initial := ""
+
+  // A single "=" stands for an empty initial response
+  if len(args) > 1 && args[1] != "=" {
+    initial = args[1]
+  }
+
+  var user string
+  var err error
+
+  switch mechanism {
+  case "PLAIN":
+    if !c.plainAllowed() {
+      c.Write("-ERR [AUTH] Plaintext authentication disallowed on non-secure connections")
+      return
+    }
+
+    user, err = c.authPlain(initial)
+  case "CRAM-MD5":
+    if !c.server.cramMD5 {
+      c.Write("-ERR Unsupported authentication mechanism")
+      return
+    }
+
+    if initial != "" {
+      c.Write("-ERR CRAM-MD5 does not accept an initial response")
+      return
+    }
+
+    user, err = c.authCramMD5()
+  default:
+    c.Write("-ERR Unsupported authentication mechanism")
+    return
+  }
+
+  switch err {
+  case nil:
+    c.email = user
+    c.logInfo("Authenticated as <%s> using %s", user, mechanism)
+
+    if c.enterTransaction() {
+      c.Write("+OK mailbox ready")
+    }
+  case errAuthCancelled:
+    c.Write("-ERR Authentication cancelled")
+  case errAuthInvalid:
+    c.logWarn("Authentication failed for <%s> using %s", user, mechanism)
+    c.Write("-ERR [AUTH] Authentication failed")
+  default:
+    c.logWarn("Authentication exchange failed: %v", err)
+    c.Write("-ERR Cannot decode authentication response")
+  }
+}
+
+// authPlain runs the PLAIN exchange (RFC 4616)
+func (c *Client) authPlain(initial string) (string, error) {
+  resp := initial
+
+  if resp == "" {
+    var err error
+
+    if resp, err = c.readAuthResponse(""); err != nil {
+      return "", err
+    }
+  }
+
+  user, pass, err := data.DecodeSaslPlain(resp)
+
+  if err != nil {
+    return "", err
+  }
+
+  if !c.server.Store.LoginUser(user, pass) {
+    return user, errAuthInvalid
+  }
+
+  return user, nil
+}
+
+// authCramMD5 runs the CRAM-MD5 exchange (RFC 2195) with a fresh challenge
+func (c *Client) authCramMD5() (string, error) {
+  challenge := data.NewCramChallenge(c.server.domain)
+  resp, err := c.readAuthResponse(base64.StdEncoding.EncodeToString([]byte(challenge)))
+
+  if err != nil {
+    return "", err
+  }
+
+  user, digest, err := data.DecodeCramResponse(resp)
+
+  if err != nil {
+    return "", err
+  }
+
+  if !c.server.Store.LoginCramMD5(user, challenge, digest) {
+    return user, errAuthInvalid
+  }
+
+  return user, nil
+}
+
+// readAuthResponse sends a continuation with the challenge and reads the
+// client response line. The response is not logged, it carries credentials.
+func (c *Client) readAuthResponse(challenge string) (string, error) {
+  c.Write("+ " + challenge)
+
+  if err := c.conn.SetReadDeadline(c.nextDeadline()); err != nil {
+    return "", err
+  }
+
+  line, err := c.bufin.ReadString('\n')
+
+  if err != nil {
+    return "", err
+  }
+
+  line = strings.TrimRight(line, "\r\n")
+
+  if line == "*" {
+    return "", errAuthCancelled
+  }
+
+  return line, nil
+}
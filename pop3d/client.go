@@ -2,6 +2,7 @@ package pop3d
 
 import (
   "bufio"
+  "crypto/tls"
   "fmt"
   "net"
   "strconv"
@@ -9,6 +10,7 @@ import (
   "time"
   "errors"
 
+  "github.com/fitraditya/surelin-smtpd/data"
   "github.com/fitraditya/surelin-smtpd/log"
 )
 
@@ -31,49 +33,69 @@ type Client struct {
   kill_time   int64
   id          int64
   email       string
+  tls_on      bool
+  deleted     map[int]string
+  messages    []data.MessageHead
+  locked      bool
 }
 
 // Commands are dispatched to the appropriate handlers
 func (c *Client) handle(cmd string, args []string, line string) (ret bool) {
-  c.logTrace("In state %d, got command '%s', args '%s'", c.state, cmd, args)
-  c.logTrace(">" + cmd + "<")
   arg, _ := c.parseArgs(args, 0)
-  c.logTrace("line>" + arg + "<")
-  c.logTrace(line)
 
   if cmd == "USER" && c.state == UNAUTHORIZED {
+    if !c.plainAllowed() {
+      c.Write("-ERR [AUTH] Plaintext authentication disallowed on non-secure connections")
+      return false
+    }
+
     c.email, _ = c.parseArgs(args, 0)
 
     if c.server.Store.CheckUserExists(c.email) {
       c.Write("+OK name is a valid mailbox")
-      c.logTrace(">+OK name is a valid mailbox")
     } else {
       c.Write("-ERR never heard of mailbox name " + c.email)
-      c.logTrace(">-ERR never heard of mailbox name " + c.email)
     }
 
     return false
   } else if cmd == "PASS" && c.state == UNAUTHORIZED {
+    if !c.plainAllowed() {
+      c.Write("-ERR [AUTH] Plaintext authentication disallowed on non-secure connections")
+      return false
+    }
+
     pass, _ := c.parseArgs(args, 0)
 
     if c.server.Store.LoginUser(c.email, pass) {
-      c.Write("+OK mailbox ready")
-      c.logTrace(">+OK mailbox ready")
-      c.enterState(TRANSACTION)
+      if c.enterTransaction() {
+        c.Write("+OK mailbox ready")
+      }
     } else {
       c.Write("-ERR invalid password")
-      c.logTrace(">-ERR invalid password")
     }
 
+    return false
+  } else if cmd == "STLS" && c.state == UNAUTHORIZED {
+    return c.tlsHandler()
+  } else if cmd == "AUTH" && c.state == UNAUTHORIZED {
+    c.authHandler(args)
     return false
   } else if cmd == "STAT" && c.state == TRANSACTION {
-    nr_messages, size_messages := c.server.Store.StatMails(c.email)
+    nr_messages, size_messages, _ := c.listMails()
     c.Write("+OK " + strconv.Itoa(nr_messages) + " " + strconv.Itoa(size_messages))
-    c.logTrace(">+OK " + strconv.Itoa(nr_messages) + " " + strconv.Itoa(size_messages))
   } else if cmd == "LIST" && c.state == TRANSACTION {
-    nr, tot_size, Message_head := c.server.Store.ListMails(c.email)
+    if len(args) > 0 {
+      head, ok := c.findMail(arg)
+
+      if ok {
+        c.Write("+OK " + strconv.Itoa(head.Id) + " " + strconv.Itoa(head.Size))
+      }
+
+      return false
+    }
+
+    nr, tot_size, Message_head := c.listMails()
     c.Write("+OK " + strconv.Itoa(nr) + " messages (" + strconv.Itoa(tot_size) + " octets)")
-    c.logTrace(">+OK " + strconv.Itoa(nr) + " messages (" + strconv.Itoa(tot_size) + " octets)")
 
     // Print all messages
     for _, val := range Message_head {
@@ -84,9 +106,18 @@ func (c *Client) handle(cmd string, args []string, line string) (ret bool) {
     c.Write(".")
     return false
   } else if cmd == "UIDL" && c.state == TRANSACTION {
-    nr, tot_size, Message_head := c.server.Store.ListMails(c.email)
+    if len(args) > 0 {
+      head, ok := c.findMail(arg)
+
+      if ok {
+        c.Write("+OK " + strconv.Itoa(head.Id) + " " + head.Uid)
+      }
+
+      return false
+    }
+
+    nr, tot_size, Message_head := c.listMails()
     c.Write("+OK " + strconv.Itoa(nr) + " messages (" + strconv.Itoa(tot_size) + " octets)")
-    c.logTrace(">+OK " + strconv.Itoa(nr) + " messages (" + strconv.Itoa(tot_size) + " octets)")
 
     // Print all messages
     for _, val := range Message_head {
@@ -97,35 +128,111 @@ func (c *Client) handle(cmd string, args []string, line string) (ret bool) {
     c.Write(".")
     return false
   } else if cmd == "RETR" && c.state == TRANSACTION  {
-    id, _ := c.parseArgs(args, 0)
-    i, _ := strconv.Atoi(id)
+    head, ok := c.findMail(arg)
+
+    if !ok {
+      return false
+    }
+
     // Retreive one message but don't delete it from the server
-    message, size := c.server.Store.GetMail(c.email, i)
-    c.Write("+OK " + strconv.Itoa(size) + " octets")
-    c.Write(message.Content.Body)
-    // Ending
-    c.Write(".")
+    message, err := c.server.Store.GetMail(c.email, head.Uid)
+
+    if err != nil {
+      c.Write("-ERR cannot read message " + strconv.Itoa(head.Id))
+      return false
+    }
+
+    c.Write("+OK " + strconv.Itoa(len(message)) + " octets")
+    c.writeMultiline(message)
     return false
   } else if cmd == "DELE" && c.state == TRANSACTION  {
-    //id, _ := c.parseArgs(args, 0)
-    //i, _ := strconv.Atoi(id)
-    c.Write("+OK message deleted")
-    c.logTrace(">+OK message deleted")
+    head, ok := c.findMail(arg)
+
+    if !ok {
+      return false
+    }
+
+    // Only marked here, removed from storage when entering UPDATE state
+    c.deleted[head.Id] = head.Uid
+    c.Write("+OK message " + strconv.Itoa(head.Id) + " deleted")
+    return false
+  } else if cmd == "RSET" && c.state == TRANSACTION  {
+    c.deleted = make(map[int]string)
+    nr, tot_size, _ := c.listMails()
+    c.Write("+OK maildrop has " + strconv.Itoa(nr) + " messages (" + strconv.Itoa(tot_size) + " octets)")
+    return false
+  } else if cmd == "NOOP" && c.state == TRANSACTION  {
+    c.Write("+OK")
     return false
   } else if cmd == "TOP" && c.state == TRANSACTION {
-    arg, _ := c.parseArgs(args, 0)
-    nr, _ := strconv.Atoi(arg)
-    headers := c.server.Store.TopMail(c.email, nr)
-    c.Write("+OK top message follows")
-    c.Write(headers + "\r\n\r\n.")
+    lines, err := c.parseArgs(args, 1)
+    n := 0
+
+    if err == nil {
+      n, err = strconv.Atoi(lines)
+    }
+
+    if err != nil || n < 0 {
+      c.Write("-ERR was expecting TOP msg n")
+      return false
+    }
+
+    head, ok := c.findMail(arg)
+
+    if !ok {
+      return false
+    }
+
+    top, err := c.server.Store.TopMail(c.email, head.Uid, n)
+
+    if err != nil {
+      c.Write("-ERR cannot read message " + strconv.Itoa(head.Id))
+      return false
+    }
+
+    c.Write("+OK top of message follows")
+    c.writeMultiline(top)
     return false
   } else if cmd == "CAPA" {
+    c.Write("+OK Capability list follows")
     c.Write("TOP")
     c.Write("UIDL")
+    c.Write("RESP-CODES")
+    c.Write("AUTH-RESP-CODE")
+
+    if c.state == UNAUTHORIZED {
+      if c.server.TLSConfig != nil && !c.tls_on {
+        c.Write("STLS")
+      }
+
+      if c.plainAllowed() {
+        c.Write("USER")
+      }
+
+      if mechanisms := c.mechanisms(); len(mechanisms) > 0 {
+        c.Write("SASL " + strings.Join(mechanisms, " "))
+      }
+    }
+
+    c.Write("IMPLEMENTATION Surelin")
     // Ending
     c.Write(".")
     return false
   } else if cmd == "QUIT" {
+    if c.state != TRANSACTION {
+      c.Write("+OK Surelin POP3 server signing off")
+      return true
+    }
+
+    c.enterState(UPDATE)
+    nr, _, _ := c.listMails()
+
+    if c.commitDeletes() {
+      c.Write("+OK Surelin POP3 server signing off (" + strconv.Itoa(nr) + " messages left)")
+    } else {
+      c.Write("-ERR some deleted messages not removed")
+    }
+
     return true
   } else {
     c.Write("-ERR not implemented")
@@ -135,6 +242,118 @@ func (c *Client) handle(cmd string, args []string, line string) (ret bool) {
   return false
 }
 
+// listMails returns the messages of the maildrop snapshot which are not
+// marked as deleted, with their count and total size
+func (c *Client) listMails() (nr int, size int, heads []data.MessageHead) {
+  for _, h := range c.messages {
+    if _, ok := c.deleted[h.Id]; ok {
+      continue
+    }
+
+    heads = append(heads, h)
+    size = size + h.Size
+  }
+
+  return len(heads), size, heads
+}
+
+// findMail looks up a message by its number, answering -ERR if there is no
+// such message or it is marked as deleted
+func (c *Client) findMail(arg string) (head data.MessageHead, ok bool) {
+  i, err := strconv.Atoi(arg)
+
+  if err != nil {
+    c.Write("-ERR invalid message number")
+    return head, false
+  }
+
+  if _, ok := c.deleted[i]; ok {
+    c.Write("-ERR message " + arg + " already deleted")
+    return head, false
+  }
+
+  if i < 1 || i > len(c.messages) {
+    c.Write("-ERR no such message")
+    return head, false
+  }
+
+  return c.messages[i-1], true
+}
+
+// commitDeletes removes the messages marked as deleted from storage, it is
+// called in the UPDATE state
+func (c *Client) commitDeletes() bool {
+  ok := true
+
+  for id, uid := range c.deleted {
+    if !c.server.Store.DeleteMail(c.email, uid) {
+      c.logWarn("Failed to delete message %d <%s>", id, uid)
+      ok = false
+    }
+  }
+
+  c.deleted = make(map[int]string)
+  return ok
+}
+
+// plainAllowed returns true if credentials may be sent in clear text, which
+// can be refused on connections without TLS
+func (c *Client) plainAllowed() bool {
+  return c.tls_on || !c.server.disablePlain
+}
+
+// STLS command (RFC 2595), returns true if the session has to be closed
+func (c *Client) tlsHandler() bool {
+  if c.tls_on {
+    c.Write("-ERR Already running in TLS")
+    return false
+  }
+
+  if c.server.TLSConfig == nil {
+    c.Write("-ERR TLS not supported")
+    return false
+  }
+
+  c.logTrace("Ready to start TLS")
+  c.Write("+OK Begin TLS negotiation")
+
+  // Upgrade to TLS
+  tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+  err := tlsConn.Handshake()
+
+  if err != nil {
+    c.logWarn("Could not TLS handshake:%v", err)
+    return true
+  }
+
+  c.conn = tlsConn
+  c.bufin = bufio.NewReader(c.conn)
+  c.bufout = bufio.NewWriter(c.conn)
+  c.tls_on = true
+
+  // Forget anything sent before the TLS negotiation
+  c.email = ""
+  return false
+}
+
+// enterTransaction starts the TRANSACTION state once the user is
+// authenticated. The maildrop is locked and its content is snapshotted for
+// the whole session, so message numbers never shift.
+func (c *Client) enterTransaction() bool {
+  if !c.server.lockMaildrop(c.email) {
+    c.logWarn("Maildrop <%s> is locked by another session", c.email)
+    c.Write("-ERR [IN-USE] Unable to lock maildrop")
+    c.email = ""
+    return false
+  }
+
+  c.locked = true
+  _, _, c.messages = c.server.Store.ListMails(c.email)
+  c.deleted = make(map[int]string)
+  c.enterState(TRANSACTION)
+  return true
+}
+
 func (c *Client) enterState(state State) {
   c.state = state
   c.logInfo("Entering state %v", state)
@@ -157,6 +376,33 @@ func (c *Client) Write(text string) {
   c.bufout.Flush()
 }
 
+// writeMultiline sends a multi-line response body, byte-stuffing lines that
+// start with "." and ending it with the termination octet (RFC 1939)
+func (c *Client) writeMultiline(text string) {
+  c.conn.SetDeadline(c.nextDeadline())
+  lines := strings.SplitAfter(text, "\r\n")
+
+  for _, line := range lines {
+    if line == "" {
+      continue
+    }
+
+    if strings.HasPrefix(line, ".") {
+      c.bufout.WriteString(".")
+    }
+
+    c.bufout.WriteString(line)
+  }
+
+  if !strings.HasSuffix(text, "\r\n") && text != "" {
+    c.bufout.WriteString("\r\n")
+  }
+
+  c.bufout.WriteString(".\r\n")
+  c.bufout.Flush()
+  c.logTrace(">> Sent %d octets multi-line response >>", len(text))
+}
+
 // Reads a line of input
 func (c *Client) readLine() (line string, err error) {
   if err = c.conn.SetReadDeadline(c.nextDeadline()); err != nil {
@@ -169,14 +415,40 @@ func (c *Client) readLine() (line string, err error) {
     return "", err
   }
 
-  c.logTrace("<< %v <<", strings.TrimRight(line, "\r\n"))
+  c.logTrace("<< %v <<", redactLine(strings.TrimRight(line, "\r\n")))
   return line, nil
 }
 
+// redactLine hides the password of PASS and the initial response of AUTH
+// from the session trace
+func redactLine(line string) string {
+  fields := strings.Fields(line)
+
+  if len(fields) < 2 {
+    return line
+  }
+
+  switch strings.ToUpper(fields[0]) {
+  case "PASS":
+    return fields[0] + " ***"
+  case "AUTH":
+    if len(fields) > 2 {
+      return fields[0] + " " + fields[1] + " ***"
+    }
+  }
+
+  return line
+}
+
 func (c *Client) parseCmd(line string) (cmd string, arg []string) {
   line = strings.Trim(line, "\r \n")
-  cm := strings.Split(line, " ")
-  return strings.ToUpper((cm[0])[0:4]), cm[1:]
+  cm := strings.Fields(line)
+
+  if len(cm) == 0 {
+    return "", nil
+  }
+
+  return strings.ToUpper(cm[0]), cm[1:]
 }
 
 func (c *Client) parseArgs(args []string, nr int) (arg string, err error) {
@@ -2,12 +2,15 @@ package pop3d
 
 import (
   "bufio"
+  "crypto/tls"
   "fmt"
   "io"
   "net"
   "runtime"
   "strconv"
+  "strings"
   "sync"
+  "sync/atomic"
   "time"
 
   "github.com/fitraditya/surelin-smtpd/config"
@@ -16,6 +19,9 @@ import (
 )
 
 var commands = map[string]bool{
+  "CAPA":     true,
+  "STLS":     true,
+  "AUTH":     true,
   "TOP":      true,
   "USER":     true,
   "PASS":     true,
@@ -24,6 +30,8 @@ var commands = map[string]bool{
   "UIDL":     true,
   "RETR":     true,
   "DELE":     true,
+  "RSET":     true,
+  "NOOP":     true,
   "QUIT":     true,
 }
 
@@ -31,12 +39,19 @@ type Server struct {
   Store           *data.DataStore
   domain          string
   maxIdleSeconds  int
-  listener        net.Listener
+  disablePlain    bool
+  cramMD5         bool
+  listeners       []net.Listener
+  mu              sync.Mutex
+  clientId        int64
   waitgroup       *sync.WaitGroup
   shutdown        bool
   Debug           bool
   DebugPath       string
   sem             chan int
+  TLSConfig       *tls.Config
+  locks           map[string]bool
+  locksMu         sync.Mutex
 }
 
 // Init a new Server object
@@ -48,41 +63,85 @@ func NewPop3Server(cfg config.Pop3Config, ds *data.DataStore) *Server {
     Store:           ds,
     domain:          cfg.Domain,
     maxIdleSeconds:  cfg.MaxIdleSeconds,
+    disablePlain:    cfg.DisablePlain,
+    cramMD5:         cfg.CramMD5,
     waitgroup:       new(sync.WaitGroup),
     sem:             maxClients,
+    locks:           make(map[string]bool),
   }
 }
 
 // Main listener loop
 func (s *Server) Start() {
   cfg := config.GetPop3Config()
+
+  if cfg.PubKey != "" {
+    log.LogTrace("Loading the certificate: %s", cfg.PubKey)
+    cert, err := tls.LoadX509KeyPair(cfg.PubKey, cfg.PrvKey)
+
+    if err != nil {
+      log.LogError("There was a problem with loading the certificate: %s", err)
+    } else {
+      s.TLSConfig = &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        ServerName:   cfg.Domain,
+      }
+    }
+  }
+
   defer s.Stop()
-  addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", cfg.Ip4address, cfg.Ip4port))
+  listener, err := s.listen(cfg.Ip4address, cfg.Ip4port, "POP3")
 
   if err != nil {
-    log.LogError("Failed to build tcp4 address: %v", err)
     // TODO More graceful early-shutdown procedure
     s.Stop()
     return
   }
 
+  if cfg.TLSIp4port > 0 {
+    if s.TLSConfig == nil {
+      log.LogError("POP3S listener requires a certificate, not starting it")
+    } else if tl, err := s.listen(cfg.TLSIp4address, cfg.TLSIp4port, "POP3S"); err == nil {
+      go s.Serve(tl, true)
+    }
+  }
+
+  s.Serve(listener, false)
+}
+
+// listen opens a tcp4 listener for the given address and port
+func (s *Server) listen(ip net.IP, port int, name string) (net.Listener, error) {
+  addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", ip, port))
+
+  if err != nil {
+    log.LogError("Failed to build tcp4 address: %v", err)
+    return nil, err
+  }
+
   // Start listening for POP3 connections
-  log.LogInfo("POP3 listening on TCP4 %v", addr)
-  s.listener, err = net.ListenTCP("tcp4", addr)
+  log.LogInfo("%s listening on TCP4 %v", name, addr)
+  listener, err := net.ListenTCP("tcp4", addr)
 
   if err != nil {
-    log.LogError("POP3 failed to start tcp4 listener: %v", err)
-    // TODO More graceful early-shutdown procedure
-    s.Stop()
-    return
+    log.LogError("%s failed to start tcp4 listener: %v", name, err)
+    return nil, err
   }
 
+  return listener, nil
+}
+
+// Serve accepts POP3 connections on an already open listener, connections
+// are wrapped in TLS right away if implicitTLS is set
+func (s *Server) Serve(listener net.Listener, implicitTLS bool) {
+  s.mu.Lock()
+  s.listeners = append(s.listeners, listener)
+  s.mu.Unlock()
+
   var tempDelay time.Duration
-  var clientId int64
 
   // Handle incoming connections
-  for clientId = 1; ; clientId++ {
-    if conn, err := s.listener.Accept(); err != nil {
+  for {
+    if conn, err := listener.Accept(); err != nil {
       if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
         // Temporary error, sleep for a bit and try again
         if tempDelay == 0 {
@@ -113,6 +172,12 @@ func (s *Server) Start() {
       log.LogInfo("There are now %s serving goroutines", strconv.Itoa(runtime.NumGoroutine()))
       host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
       s.sem <- 1
+
+      // Implicit TLS, the handshake happens on the first read or write
+      if implicitTLS {
+        conn = tls.Server(conn, s.TLSConfig)
+      }
+
       go s.handleClient(&Client{
         state:      1,
         server:     s,
@@ -121,17 +186,23 @@ func (s *Server) Start() {
         time:       time.Now().Unix(),
         bufin:      bufio.NewReader(conn),
         bufout:     bufio.NewWriter(conn),
-        id:         clientId,
+        id:         atomic.AddInt64(&s.clientId, 1),
+        tls_on:     implicitTLS,
       })
     }
   }
 }
 
-// Stop requests the POP3 server closes it's listener
+// Stop requests the POP3 server closes it's listeners
 func (s *Server) Stop() {
   log.LogTrace("POP3 shutdown requested, connections will be drained")
   s.shutdown = true
-  s.listener.Close()
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, listener := range s.listeners {
+    listener.Close()
+  }
 }
 
 // Drain causes the caller to block until all active POP3 sessions have finished
@@ -140,7 +211,34 @@ func (s *Server) Drain() {
   log.LogTrace("POP3 connections drained")
 }
 
+// lockMaildrop takes the exclusive lock on a maildrop, it returns false if
+// another session holds it already
+func (s *Server) lockMaildrop(email string) bool {
+  s.locksMu.Lock()
+  defer s.locksMu.Unlock()
+  email = strings.ToLower(email)
+
+  if s.locks[email] {
+    return false
+  }
+
+  s.locks[email] = true
+  return true
+}
+
+// unlockMaildrop releases the lock taken by lockMaildrop
+func (s *Server) unlockMaildrop(email string) {
+  s.locksMu.Lock()
+  defer s.locksMu.Unlock()
+  delete(s.locks, strings.ToLower(email))
+}
+
 func (s *Server) closeClient(c *Client) {
+  if c.locked {
+    s.unlockMaildrop(c.email)
+    c.locked = false
+  }
+
   c.bufout.Flush()
   time.Sleep(200 * time.Millisecond)
   c.conn.Close()
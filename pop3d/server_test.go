@@ -0,0 +1,318 @@
+package pop3d
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/data"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestStore returns a memory store with the user alice@example.com,
+// password "secret"
+func newTestStore(t *testing.T) *data.DataStore {
+	ds := &data.DataStore{Storage: data.CreateMemoryStore(config.DataStoreConfig{})}
+	u := &data.User{Email: "alice@example.com", Domain: "example.com", IsActive: true}
+	u.SetPassword("secret")
+
+	if err := ds.Storage.StoreUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	return ds
+}
+
+// deliver stores raw in the maildrop of alice@example.com and returns its id
+func deliver(t *testing.T, ds *data.DataStore, raw string) string {
+	m := data.ParseRawMessage(bson.NewObjectId().Hex(), raw)
+	m.To = []*data.Path{data.PathFromString("alice@example.com")}
+
+	if _, err := ds.Storage.Store(m); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := ds.Storage.Fetch("alice@example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return (*messages)[len(*messages)-1].Id
+}
+
+// startTestServer runs Serve on a localhost listener and returns its address
+func startTestServer(t *testing.T, ds *data.DataStore) string {
+	cfg := config.Pop3Config{
+		Domain:         "pop.example.com",
+		MaxClients:     10,
+		MaxIdleSeconds: 30,
+	}
+
+	s := NewPop3Server(cfg, ds)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve(l, false)
+	t.Cleanup(s.Stop)
+	return l.Addr().String()
+}
+
+// testConn is a POP3 client session for the tests
+type testConn struct {
+	t *testing.T
+	*textproto.Conn
+}
+
+// dial connects to addr and reads the greeting
+func dial(t *testing.T, addr string) *testConn {
+	conn, err := textproto.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	c := &testConn{t, conn}
+
+	if reply := c.read(); !strings.HasPrefix(reply, "+OK") {
+		t.Fatalf("Greeting is %q", reply)
+	}
+
+	return c
+}
+
+func (c *testConn) read() string {
+	line, err := c.ReadLine()
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return line
+}
+
+// cmd sends a command and returns the first line of the reply
+func (c *testConn) cmd(format string, args ...interface{}) string {
+	if err := c.PrintfLine(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.read()
+}
+
+// expect sends a command and fails unless the reply starts with prefix
+func (c *testConn) expect(prefix string, format string, args ...interface{}) string {
+	reply := c.cmd(format, args...)
+
+	if !strings.HasPrefix(reply, prefix) {
+		c.t.Fatalf("%s: got %q, want %s", strings.Fields(format)[0], reply, prefix)
+	}
+
+	return reply
+}
+
+// body reads a multi-line response body, dot-stuffing undone
+func (c *testConn) body() []string {
+	lines, err := c.ReadDotLines()
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return lines
+}
+
+// login authenticates as alice@example.com
+func (c *testConn) login() {
+	c.expect("+OK", "USER alice@example.com")
+	c.expect("+OK", "PASS secret")
+}
+
+// quit ends the session and waits for the server to close it
+func (c *testConn) quit() string {
+	reply := c.cmd("QUIT")
+
+	if _, err := c.ReadLine(); err == nil {
+		c.t.Fatal("Session still open after QUIT")
+	}
+
+	return reply
+}
+
+func TestDeleteCommittedOnQuit(t *testing.T) {
+	ds := newTestStore(t)
+	first := deliver(t, ds, "Subject: one\r\n\r\nfirst\r\n")
+	deliver(t, ds, "Subject: two\r\n\r\nsecond\r\n")
+	deliver(t, ds, "Subject: three\r\n\r\nthird\r\n")
+
+	c := dial(t, startTestServer(t, ds))
+	c.login()
+
+	// Marked only, the marks go with RSET
+	c.expect("+OK", "DELE 2")
+	c.expect("-ERR", "DELE 2")
+	c.expect("-ERR", "RETR 2")
+
+	if reply := c.expect("+OK", "STAT"); !strings.HasPrefix(reply, "+OK 2 ") {
+		t.Errorf("STAT after DELE is %q, want 2 messages", reply)
+	}
+
+	if reply := c.expect("+OK", "RSET"); !strings.Contains(reply, " 3 messages") {
+		t.Errorf("RSET is %q, want 3 messages", reply)
+	}
+
+	c.expect("+OK", "RETR 2")
+	c.body()
+
+	if messages, _ := ds.Storage.Fetch("alice@example.com"); len(*messages) != 3 {
+		t.Fatalf("Storage has %d messages before QUIT, want 3", len(*messages))
+	}
+
+	// Numbers keep their message while others are marked
+	c.expect("+OK", "DELE 1")
+	c.expect("+OK", "LIST")
+
+	if lines := c.body(); len(lines) != 2 || !strings.HasPrefix(lines[0], "2 ") || !strings.HasPrefix(lines[1], "3 ") {
+		t.Errorf("LIST after DELE 1 is %q", lines)
+	}
+
+	if reply := c.quit(); !strings.HasPrefix(reply, "+OK") || !strings.Contains(reply, "2 messages left") {
+		t.Errorf("QUIT is %q", reply)
+	}
+
+	messages, err := ds.Storage.Fetch("alice@example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*messages) != 2 {
+		t.Fatalf("Storage has %d messages after QUIT, want 2", len(*messages))
+	}
+
+	for _, m := range *messages {
+		if m.Id == first {
+			t.Error("Message deleted in the session still stored")
+		}
+	}
+}
+
+func TestMaildropLock(t *testing.T) {
+	ds := newTestStore(t)
+	deliver(t, ds, "Subject: one\r\n\r\nfirst\r\n")
+	addr := startTestServer(t, ds)
+
+	first := dial(t, addr)
+	first.login()
+
+	second := dial(t, addr)
+	second.expect("+OK", "USER alice@example.com")
+
+	if reply := second.expect("-ERR", "PASS secret"); !strings.HasPrefix(reply, "-ERR [IN-USE]") {
+		t.Errorf("Second session got %q, want [IN-USE]", reply)
+	}
+
+	second.expect("-ERR", "STAT")
+
+	// Released when the session is closed
+	first.quit()
+	second.login()
+	second.expect("+OK", "STAT")
+}
+
+func TestSnapshotNumbering(t *testing.T) {
+	ds := newTestStore(t)
+	uid := deliver(t, ds, "Subject: one\r\n\r\nfirst\r\n")
+	addr := startTestServer(t, ds)
+
+	c := dial(t, addr)
+	c.login()
+
+	// Mail arriving during the session is left for the next one
+	deliver(t, ds, "Subject: two\r\n\r\nsecond\r\n")
+
+	if reply := c.expect("+OK", "STAT"); !strings.HasPrefix(reply, "+OK 1 ") {
+		t.Errorf("STAT is %q, want the snapshot of 1 message", reply)
+	}
+
+	if reply := c.expect("+OK", "UIDL 1"); reply != "+OK 1 "+uid {
+		t.Errorf("UIDL 1 is %q, want %s", reply, uid)
+	}
+
+	c.expect("-ERR", "RETR 2")
+	c.quit()
+
+	c = dial(t, addr)
+	c.login()
+
+	if reply := c.expect("+OK", "STAT"); !strings.HasPrefix(reply, "+OK 2 ") {
+		t.Errorf("STAT in a new session is %q, want 2 messages", reply)
+	}
+}
+
+func TestMessageUnreadable(t *testing.T) {
+	ds := newTestStore(t)
+	uid := deliver(t, ds, "Subject: one\r\n\r\nfirst\r\n")
+
+	c := dial(t, startTestServer(t, ds))
+	c.login()
+
+	c.expect("-ERR", "TOP 1")
+	c.expect("-ERR", "TOP 1 x")
+	c.expect("-ERR", "TOP 1 -1")
+
+	// Gone from storage, still in the snapshot
+	if err := ds.Storage.DeleteOne(uid); err != nil {
+		t.Fatal(err)
+	}
+
+	c.expect("-ERR", "RETR 1")
+	c.expect("-ERR", "TOP 1 0")
+	c.expect("+OK", "NOOP")
+}
+
+func TestRetrAndTop(t *testing.T) {
+	ds := newTestStore(t)
+	raw := "Subject: dots\r\nFrom: carol@remote.org\r\n\r\n" +
+		"first\r\n.hidden\r\n.\r\n..two\r\nlast\r\n"
+	deliver(t, ds, raw)
+
+	c := dial(t, startTestServer(t, ds))
+	c.login()
+
+	if reply := c.expect("+OK", "LIST 1"); reply != fmt.Sprintf("+OK 1 %d", len(raw)) {
+		t.Errorf("LIST 1 is %q, want %d octets", reply, len(raw))
+	}
+
+	c.expect("+OK", "RETR 1")
+
+	// The lone "." and the lines starting with one come back as sent
+	if got := strings.Join(c.body(), "\r\n") + "\r\n"; got != raw {
+		t.Errorf("RETR returned %q, want %q", got, raw)
+	}
+
+	tests := []struct {
+		n    int
+		body []string
+	}{
+		{0, nil},
+		{2, []string{"first", ".hidden"}},
+		{10, []string{"first", ".hidden", ".", "..two", "last"}},
+	}
+
+	for _, tt := range tests {
+		c.expect("+OK", "TOP 1 %d", tt.n)
+		want := append([]string{"Subject: dots", "From: carol@remote.org", ""}, tt.body...)
+
+		if got := c.body(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("TOP 1 %d returned %q, want %q", tt.n, got, want)
+		}
+	}
+}
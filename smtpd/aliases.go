@@ -0,0 +1,172 @@
+package smtpd
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+const (
+	// Aliases nested deeper than this are taken as a loop
+	maxAliasDepth = 10
+
+	// Messages with more Received headers are taken as looping (RFC 5321 6.3)
+	maxHops = 50
+)
+
+var errMailLoop = errors.New("Mail forwarding loop")
+
+// expandRecipient resolves rcpt through the aliases, plus addressing and the
+// catch-all of its domain into the addresses the message is delivered to.
+// Local results have a mailbox, remote ones are forwards. An empty result
+// means rcpt is unknown. If rcpt is listed in deliveredTo we forwarded the
+// message before, it came back and forwarding it again is a loop.
+func expandRecipient(ds *data.DataStore, rcpt string, deliveredTo []string) ([]string, error) {
+	targets := make([]string, 0)
+
+	if err := expandAddress(ds, rcpt, 0, make(map[string]bool), &targets); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range deliveredTo {
+		if !strings.EqualFold(addr, rcpt) {
+			continue
+		}
+
+		for _, t := range targets {
+			if !ds.IsLocalDomain(data.DomainOf(t)) {
+				return nil, errMailLoop
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+func expandAddress(ds *data.DataStore, addr string, depth int, seen map[string]bool, targets *[]string) error {
+	local, domain, err := ParseEmailAddress(addr)
+
+	if err != nil {
+		return err
+	}
+
+	domain = strings.ToLower(domain)
+
+	if !ds.IsLocalDomain(domain) {
+		*targets = appendAddress(*targets, addr)
+		return nil
+	}
+
+	if depth > maxAliasDepth {
+		return errMailLoop
+	}
+
+	addr = data.NormalizeEmail(local + "@" + domain)
+
+	// Reached again through another alias, it is delivered once
+	if seen[addr] {
+		return nil
+	}
+
+	seen[addr] = true
+	alias, err := ds.Storage.LoadAlias(addr)
+
+	if err == nil {
+		for _, t := range alias.Targets {
+			// An alias to itself keeps a copy in its own mailbox
+			if strings.EqualFold(t, addr) {
+				if err := expandMailbox(ds, addr, targets); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := expandAddress(ds, t, depth+1, seen, targets); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	} else if err != data.ErrNotFound {
+		return err
+	}
+
+	if ok, err := ds.ValidRecipient(addr); err != nil {
+		return err
+	} else if ok {
+		*targets = appendAddress(*targets, addr)
+		return nil
+	}
+
+	// Plus addressing, user+ext@domain goes to user@domain
+	if mailbox, err := ParseMailboxName(local); err == nil && mailbox+"@"+domain != addr {
+		if d, err := ds.Storage.LoadDomain(domain); err == nil && d.PlusAddressing {
+			return expandAddress(ds, mailbox+"@"+domain, depth+1, seen, targets)
+		}
+	}
+
+	// Catch-all of the domain
+	alias, err = ds.Storage.LoadAlias("@" + domain)
+
+	if err == data.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, t := range alias.Targets {
+		if err := expandAddress(ds, t, depth+1, seen, targets); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandMailbox adds the mailbox of addr to targets if it exists
+func expandMailbox(ds *data.DataStore, addr string, targets *[]string) error {
+	ok, err := ds.ValidRecipient(addr)
+
+	if ok {
+		*targets = appendAddress(*targets, addr)
+	}
+
+	return err
+}
+
+// appendAddress appends addr to list unless it is there already
+func appendAddress(list []string, addr string) []string {
+	for _, a := range list {
+		if strings.EqualFold(a, addr) {
+			return list
+		}
+	}
+
+	return append(list, addr)
+}
+
+// headerValues returns the values of the header name of the message msg, or
+// nil if it cannot be parsed
+func headerValues(msg string, name string) []string {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+
+	if err != nil {
+		return nil
+	}
+
+	return m.Header[name]
+}
+
+// deliveredTo returns the addresses in the Delivered-To headers of msg
+func deliveredTo(msg string) []string {
+	addrs := make([]string, 0)
+
+	for _, v := range headerValues(msg, "Delivered-To") {
+		addrs = append(addrs, strings.Trim(v, "<> "))
+	}
+
+	return addrs
+}
@@ -0,0 +1,103 @@
+package smtpd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+// newAliasStore returns the test store with more users, aliases and domains:
+// noplus.example without plus addressing and catch.example delivering
+// everything to alice
+func newAliasStore(t *testing.T) *data.DataStore {
+	ds := newTestStore(t)
+
+	for _, name := range []string{"noplus.example", "catch.example"} {
+		if err := ds.AddDomain(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ds.SetPlusAddressing("noplus.example", false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"bob@example.com", "keep@example.com", "carol@noplus.example"} {
+		if err := ds.Storage.StoreUser(&data.User{Email: email, Domain: data.DomainOf(email), IsActive: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aliases := map[string][]string{
+		"info@example.com": {"alice@example.com", "bob@example.com"},
+		"team@example.com": {"info@example.com", "dave@remote.org"},
+		"keep@example.com": {"keep@example.com", "keep@remote.org"},
+		"@catch.example":   {"alice@example.com"},
+	}
+
+	for address, targets := range aliases {
+		if err := ds.AddAlias(address, targets); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ds
+}
+
+func TestExpandRecipient(t *testing.T) {
+	ds := newAliasStore(t)
+
+	tests := []struct {
+		rcpt    string
+		targets []string
+	}{
+		{"alice@example.com", []string{"alice@example.com"}},
+		{"Alice@EXAMPLE.com", []string{"alice@example.com"}},
+		{"alice+news@example.com", []string{"alice@example.com"}},
+		{"carol@noplus.example", []string{"carol@noplus.example"}},
+		{"carol+news@noplus.example", []string{}},
+		{"info@example.com", []string{"alice@example.com", "bob@example.com"}},
+		{"team@example.com", []string{"alice@example.com", "bob@example.com", "dave@remote.org"}},
+		{"keep@example.com", []string{"keep@example.com", "keep@remote.org"}},
+		{"anyone@catch.example", []string{"alice@example.com"}},
+		{"nobody@example.com", []string{}},
+		{"dave@remote.org", []string{"dave@remote.org"}},
+	}
+
+	for _, tt := range tests {
+		targets, err := expandRecipient(ds, tt.rcpt, nil)
+
+		if err != nil {
+			t.Errorf("expandRecipient(%s) failed: %s", tt.rcpt, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("expandRecipient(%s) = %v, want %v", tt.rcpt, targets, tt.targets)
+		}
+	}
+}
+
+func TestExpandRecipientLoop(t *testing.T) {
+	ds := newAliasStore(t)
+
+	tests := []struct {
+		rcpt        string
+		deliveredTo []string
+		err         error
+	}{
+		// Forwarded by us before, forwarding again is a loop
+		{"team@example.com", []string{"Team@example.com"}, errMailLoop},
+		{"keep@example.com", []string{"keep@example.com"}, errMailLoop},
+		// Delivered locally only, the copy is kept
+		{"info@example.com", []string{"info@example.com"}, nil},
+		{"team@example.com", []string{"other@example.com"}, nil},
+	}
+
+	for _, tt := range tests {
+		if _, err := expandRecipient(ds, tt.rcpt, tt.deliveredTo); err != tt.err {
+			t.Errorf("expandRecipient(%s, %v) returned %v, want %v", tt.rcpt, tt.deliveredTo, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+var (
+	errAuthCancelled = errors.New("Authentication cancelled")
+	errAuthInvalid   = errors.New("Authentication credentials invalid")
+)
+
+// authPlain runs the PLAIN exchange (RFC 4616), using the initial response
+// from the AUTH command line if one was given.
+func (c *Client) authPlain(initial string) (string, error) {
+	resp := initial
+
+	if resp == "" {
+		var err error
+
+		if resp, err = c.readAuthResponse(""); err != nil {
+			return "", err
+		}
+	}
+
+	user, pass, err := data.DecodeSaslPlain(resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !c.server.Store.LoginUser(user, pass) {
+		return user, errAuthInvalid
+	}
+
+	return user, nil
+}
+
+// authLogin runs the LOGIN exchange, prompting for the username (unless sent
+// as initial response) and then the password.
+func (c *Client) authLogin(initial string) (string, error) {
+	resp := initial
+	var err error
+
+	if resp == "" {
+		if resp, err = c.readAuthResponse("VXNlcm5hbWU6"); err != nil {
+			return "", err
+		}
+	}
+
+	user, err := data.DecodeSaslString(resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if resp, err = c.readAuthResponse("UGFzc3dvcmQ6"); err != nil {
+		return "", err
+	}
+
+	pass, err := data.DecodeSaslString(resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !c.server.Store.LoginUser(user, pass) {
+		return user, errAuthInvalid
+	}
+
+	return user, nil
+}
+
+// authCramMD5 runs the CRAM-MD5 exchange (RFC 2195) with a fresh challenge.
+func (c *Client) authCramMD5() (string, error) {
+	challenge := data.NewCramChallenge(c.server.domain)
+	resp, err := c.readAuthResponse(base64.StdEncoding.EncodeToString([]byte(challenge)))
+
+	if err != nil {
+		return "", err
+	}
+
+	user, digest, err := data.DecodeCramResponse(resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !c.server.Store.LoginCramMD5(user, challenge, digest) {
+		return user, errAuthInvalid
+	}
+
+	return user, nil
+}
+
+// readAuthResponse sends a 334 challenge and reads the client response line.
+// The response is not logged, it carries credentials.
+func (c *Client) readAuthResponse(challenge string) (string, error) {
+	c.Write("334", challenge)
+
+	if err := c.conn.SetReadDeadline(c.nextDeadline()); err != nil {
+		return "", err
+	}
+
+	line, err := c.bufin.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "*" {
+		return "", errAuthCancelled
+	}
+
+	return line, nil
+}
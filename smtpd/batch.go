@@ -0,0 +1,293 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+const (
+	// Recipients per transaction, servers take at least 100 (RFC 5321 4.5.3.1.8)
+	maxBatchRecipients = 100
+
+	// How long an idle session is kept for the next message to the same
+	// destination
+	sessionIdle = 30 * time.Second
+)
+
+// batch is a set of recipients of a queued message sent in one transaction:
+// same destination and same message data
+type batch struct {
+	dest       string
+	limits     string // Key the limits of the destination are counted by
+	domain     string
+	msg        string
+	recipients []int // Indexes in the recipients of the message
+}
+
+// session is an open SMTP session with a destination
+type session struct {
+	c       *smtp.Client
+	dest    string
+	limits  string
+	tlsInfo string
+	used    time.Time
+}
+
+// batches groups the pending recipients of q by destination. Recipients
+// forwarded by an alias get their own batch, their copy has a Delivered-To
+// header. Invalid addresses are failed right away.
+func (md *Mailer) batches(q *data.QueuedMessage) []*batch {
+	batches := make([]*batch, 0)
+	open := make(map[string]*batch)
+	limits := make(map[string]string)
+
+	for i, r := range q.Recipients {
+		if r.Status != data.QueuePending {
+			continue
+		}
+
+		at := strings.LastIndex(r.Address, "@")
+
+		if at < 0 {
+			md.record(q, i, "", permanentError{fmt.Errorf("Invalid recipient address: <%s>", r.Address), "5.1.3"})
+			continue
+		}
+
+		domain := r.Address[at+1:]
+		dest := md.destination(domain)
+		key := dest
+
+		if _, ok := limits[dest]; !ok {
+			limits[dest] = md.limitsKey(domain)
+		}
+		msg := q.Data
+
+		// Forwarded copies say who forwarded them, so loops are found
+		if !strings.EqualFold(r.Address, r.Original) {
+			msg = "Delivered-To: " + r.Original + "\r\n" + msg
+			key += "\x00" + strings.ToLower(r.Original)
+		}
+
+		b := open[key]
+
+		if b == nil || len(b.recipients) >= maxBatchRecipients {
+			b = &batch{dest: dest, limits: limits[dest], domain: domain, msg: msg}
+			open[key] = b
+			batches = append(batches, b)
+		}
+
+		b.recipients = append(b.recipients, i)
+	}
+
+	return batches
+}
+
+// destination returns the key of the server mail to domain goes to, the
+// relay host routed to or the mail exchangers of the domain
+func (md *Mailer) destination(domain string) string {
+	if r := md.route(domain); r != nil {
+		return fmt.Sprintf("relay:%s@%s:%d", r.Username, r.Host, r.Port)
+	}
+
+	return "mx:" + strings.ToLower(domain)
+}
+
+// limitsKey returns the key the limits of mail to domain are counted by: the
+// relay host routed to, or the primary mail exchanger of the domain, as big
+// providers serve many domains from the same exchangers. If the exchangers
+// cannot be found it is the domain, connecting will fail the same way.
+func (md *Mailer) limitsKey(domain string) string {
+	if md.route(domain) != nil {
+		return md.destination(domain)
+	}
+
+	mx, err := md.lookupMX(domain)
+
+	if err != nil {
+		return md.destination(domain)
+	}
+
+	return "mx:" + strings.ToLower(mx[0].Host)
+}
+
+// deliverBatch sends q to the recipients of b in one transaction and records
+// the result for each of them. If the limits of the destination hold the
+// transaction back it returns how long to wait, the recipients stay as they
+// are.
+func (md *Mailer) deliverBatch(q *data.QueuedMessage, b *batch) time.Duration {
+	to := make([]string, len(b.recipients))
+
+	for j, i := range b.recipients {
+		to[j] = q.Recipients[i].Address
+	}
+
+	if wait := md.throttle(b.limits, false); wait > 0 {
+		return wait
+	}
+
+	s, wait, err := md.getSession(b)
+
+	if wait > 0 {
+		return wait
+	}
+
+	if err != nil {
+		if isBusy(err) {
+			md.busy(b.limits, err)
+		}
+
+		for _, i := range b.recipients {
+			md.record(q, i, "", err)
+		}
+
+		return 0
+	}
+
+	// Another worker may have taken the last transaction of the minute
+	if wait := md.throttle(b.limits, true); wait > 0 {
+		md.putSession(s)
+		return wait
+	}
+
+	errs, err := send(s.c, q.From, to, b.msg)
+	busy := err
+
+	for _, e := range errs {
+		if isBusy(e) {
+			busy = e
+		}
+	}
+
+	// A session which still speaks SMTP is kept for the next message, not
+	// one the server wants us off
+	_, smtpErr := err.(*textproto.Error)
+
+	if isBusy(busy) {
+		md.busy(b.limits, busy)
+		md.closeSession(s, true)
+	} else if err == nil || smtpErr {
+		md.relieve(b.limits)
+		md.putSession(s)
+	} else {
+		md.closeSession(s, false)
+	}
+
+	for j, i := range b.recipients {
+		if errs != nil && errs[j] != nil {
+			md.record(q, i, s.tlsInfo, errs[j])
+		} else {
+			md.record(q, i, s.tlsInfo, err)
+		}
+	}
+
+	return 0
+}
+
+// getSession returns an idle session with the destination of b if one is
+// still alive, or a new one. If the sessions counted by the limits of the
+// destination are at the limit it returns how long to wait instead.
+func (md *Mailer) getSession(b *batch) (*session, time.Duration, error) {
+	for s := md.popSession(b.dest); s != nil; s = md.popSession(b.dest) {
+		if err := s.c.Reset(); err == nil {
+			return s, 0, nil
+		}
+
+		md.closeSession(s, false)
+	}
+
+	if !md.openSlot(b.limits) {
+		return nil, connectionWait, nil
+	}
+
+	c, tlsInfo, err := md.connect(b.domain)
+
+	if err != nil {
+		md.closeSlot(b.limits)
+		return nil, 0, err
+	}
+
+	return &session{c: c, dest: b.dest, limits: b.limits, tlsInfo: tlsInfo}, 0, nil
+}
+
+// popSession takes the last idle session with dest out of the pool
+func (md *Mailer) popSession(dest string) *session {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	idle := md.pool[dest]
+
+	for len(idle) > 0 {
+		s := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+		md.pool[dest] = idle
+
+		if time.Since(s.used) < sessionIdle {
+			return s
+		}
+
+		go md.closeSession(s, true)
+	}
+
+	return nil
+}
+
+// putSession keeps s in the pool of idle sessions with its destination
+func (md *Mailer) putSession(s *session) {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	if md.pool == nil {
+		md.pool = make(map[string][]*session)
+	}
+
+	s.used = time.Now()
+	md.pool[s.dest] = append(md.pool[s.dest], s)
+}
+
+// closeIdle ends the sessions idle for too long, and forgets destinations
+// with nothing going on
+func (md *Mailer) closeIdle() {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	for dest, idle := range md.pool {
+		keep := idle[:0]
+
+		for _, s := range idle {
+			if time.Since(s.used) < sessionIdle {
+				keep = append(keep, s)
+			} else {
+				go md.closeSession(s, true)
+			}
+		}
+
+		if len(keep) == 0 {
+			delete(md.pool, dest)
+		} else {
+			md.pool[dest] = keep
+		}
+	}
+
+	now := time.Now()
+
+	for dest, l := range md.loads {
+		if l.open == 0 && now.Sub(l.blocked) > busyBackoffMax && (len(l.sent) == 0 || now.Sub(l.sent[len(l.sent)-1]) >= time.Minute) {
+			delete(md.loads, dest)
+		}
+	}
+}
+
+// closeSession ends s, with QUIT if quit is set and the session is still
+// usable
+func (md *Mailer) closeSession(s *session, quit bool) {
+	if !quit || s.c.Quit() != nil {
+		s.c.Close()
+	}
+
+	md.closeSlot(s.limits)
+}
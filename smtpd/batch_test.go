@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+// newTestMailer returns a mailer delivering mail for remote.org to the fake
+// server
+func newTestMailer(t *testing.T, fake *fakeServer) *Mailer {
+	port := smtpPort
+	smtpPort = fake.Port
+	t.Cleanup(func() { smtpPort = port })
+
+	md := &Mailer{
+		Store:        newTestStore(t),
+		SendMailChan: make(chan *config.SMTPMessage, 16),
+		active:       make(map[string]bool),
+		Resolver: StaticResolver{
+			MX:    map[string][]*net.MX{"remote.org": {{Host: "mx.remote.org", Pref: 10}}},
+			Hosts: map[string][]string{"mx.remote.org": {"127.0.0.1"}},
+		},
+	}
+
+	md.Config.Domain = "example.com"
+	md.Config.OutboundTLS = tlsNone
+	md.Config.QueueRetryMin = 5 * time.Minute
+	md.Config.QueueRetryMax = 4 * time.Hour
+	md.Config.QueueLifetime = 120 * time.Hour
+	md.Config.OutboundMaxConnections = 10
+	return md
+}
+
+func TestBatchPartialSuccess(t *testing.T) {
+	fake := startFakeServer(t, "220 fake.example.net ESMTP")
+	fake.Rcpt = func(address string) string {
+		switch address {
+		case "gone@remote.org":
+			return "550 5.1.1 User unknown"
+		case "full@remote.org":
+			return "452 4.2.2 Mailbox full"
+		}
+
+		return "250 OK"
+	}
+
+	md := newTestMailer(t, fake)
+	q := data.NewQueuedMessage("alice@example.com", "Subject: hi\r\n\r\nhi\r\n")
+
+	for _, to := range []string{"bob@remote.org", "gone@remote.org", "full@remote.org", "carol@remote.org"} {
+		q.AddRecipient(to, to)
+	}
+
+	md.attempt(q)
+
+	select {
+	case to := <-fake.Delivered:
+		if len(to) != 2 || to[0] != "bob@remote.org" || to[1] != "carol@remote.org" {
+			t.Errorf("Message delivered to %v, want the accepted recipients", to)
+		}
+	default:
+		t.Fatal("Message not delivered in one transaction")
+	}
+
+	want := []struct {
+		status string
+		dsn    string
+	}{
+		{data.QueueSent, ""},
+		{data.QueueFailed, "5.1.1"},
+		{data.QueuePending, "4.2.2"},
+		{data.QueueSent, ""},
+	}
+
+	for i, w := range want {
+		if r := q.Recipients[i]; r.Status != w.status || r.DsnStatus != w.dsn {
+			t.Errorf("<%s> is %s (%s), want %s (%s)", r.Address, r.Status, r.DsnStatus, w.status, w.dsn)
+		}
+	}
+
+	// The refused recipient is bounced, the deferred one retried
+	if len(md.SendMailChan) != 1 {
+		t.Errorf("%d notifications sent, want 1", len(md.SendMailChan))
+	}
+
+	if _, err := md.Store.Storage.LoadQueued(q.Id.Hex()); err != nil {
+		t.Errorf("Message with a deferred recipient not kept in the queue: %s", err)
+	}
+}
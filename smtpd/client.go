@@ -16,7 +16,7 @@ import (
 	"github.com/fitraditya/surelin-smtpd/log"
 )
 
-var fromRegex = regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
+var fromRegex = regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])*|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
 
 const (
 	// GREET State: Waiting for HELO
@@ -55,6 +55,9 @@ type Client struct {
 	id         int64
 	tlsConn    *tls.Conn
 	trusted    bool
+	authUser   string
+	mode       Mode
+	dropped    int
 }
 
 // Commands are dispatched to the appropriate handler functions
@@ -98,7 +101,6 @@ func (c *Client) handle(cmd string, arg string, line string) {
 		c.server.killClient(c)
 	case "AUTH":
 		c.authHandler(cmd, arg)
-		c.logInfo("Got LOGIN authentication response: '%s', switching to AUTH state", arg)
 	case "STARTTLS":
 		c.tlsHandler()
 	default:
@@ -133,12 +135,20 @@ func (c *Client) greetHandler(cmd string, arg string) {
 			return
 		}
 
+		extensions := []string{"Hello " + domain + "[" + c.remoteHost + "]", "PIPELINING", "8BITMIME"}
+
 		if c.server.TLSConfig != nil && !c.tls_on {
-			c.Write("250", "Hello "+domain+"["+c.remoteHost+"]", "PIPELINING", "8BITMIME", "STARTTLS", "AUTH EXTERNAL CRAM-MD5 LOGIN PLAIN", fmt.Sprintf("SIZE %v", c.server.maxMessageBytes))
-		} else {
-			c.Write("250", "Hello "+domain+"["+c.remoteHost+"]", "PIPELINING", "8BITMIME", "AUTH EXTERNAL CRAM-MD5 LOGIN PLAIN", fmt.Sprintf("SIZE %v", c.server.maxMessageBytes))
+			extensions = append(extensions, "STARTTLS")
 		}
 
+		if c.authAllowed() && c.server.cramMD5 {
+			extensions = append(extensions, "AUTH CRAM-MD5 LOGIN PLAIN")
+		} else if c.authAllowed() {
+			extensions = append(extensions, "AUTH LOGIN PLAIN")
+		}
+
+		extensions = append(extensions, fmt.Sprintf("SIZE %v", c.server.maxMessageBytes))
+		c.Write("250", extensions...)
 		c.helo = domain
 		c.enterState(READY)
 	default:
@@ -162,14 +172,33 @@ func (c *Client) mailHandler(cmd string, arg string) {
 			return
 		}
 
+		if c.isSubmission() {
+			if !c.tls_on {
+				c.Write("530", "Must issue a STARTTLS command first")
+				return
+			}
+
+			if c.authUser == "" {
+				c.Write("530", "Authentication required")
+				return
+			}
+		}
+
 		from := m[1]
 
-		if _, _, err := ParseEmailAddress(from); err != nil {
+		// The null sender <> is used by bounces (RFC 5321 4.5.5)
+		if _, _, err := ParseEmailAddress(from); from != "" && err != nil {
 			c.Write("501", "Bad sender address syntax")
 			c.logWarn("Bad address as MAIL arg: %q, %s", from, err)
 			return
 		}
 
+		if c.isSubmission() && !strings.EqualFold(from, c.authUser) {
+			c.Write("553", "Sender address does not match authenticated user")
+			c.logWarn("Sender <%v> rejected for user <%v>", from, c.authUser)
+			return
+		}
+
 		// This is where the client may put BODY=8BITMIME, but we already
 		// read the DATA as bytes, so it does not effect our processing.
 		if m[2] != "" {
@@ -210,7 +239,8 @@ func (c *Client) mailHandler(cmd string, arg string) {
 // MAIL state -> waiting for RCPTs followed by DATA
 func (c *Client) rcptHandler(cmd string, arg string) {
 	if cmd == "RCPT" {
-		if c.from == "" {
+		// Checked by state, the sender may be the null sender
+		if c.state != MAIL {
 			c.Write("502", "Missing MAIL FROM command")
 			return
 		}
@@ -222,18 +252,60 @@ func (c *Client) rcptHandler(cmd string, arg string) {
 		}
 
 		recip := strings.Trim(arg[3:], "<> ")
-		if _, _, err := ParseEmailAddress(recip); err != nil {
+		_, domain, err := ParseEmailAddress(recip)
+
+		if err != nil {
 			c.Write("501", "Bad recipient address syntax")
 			c.logWarn("Bad address as RCPT arg: %q, %s", recip, err)
 			return
 		}
 
+		// Remote recipients are only accepted from authenticated sessions
+		// and trusted networks, we are not an open relay
+		if !c.server.isLocalDomain(domain) && !c.canRelay() {
+			c.Write("554", "Relay access denied")
+			c.logWarn("Relay access denied for <%v>", recip)
+			return
+		}
+
 		if len(c.recipients) >= c.server.maxRecips {
 			c.logWarn("Maximum limit of %v recipients reached", c.server.maxRecips)
 			c.Write("552", fmt.Sprintf("Maximum limit of %v recipients reached", c.server.maxRecips))
 			return
 		}
 
+		// Local recipients need a mailbox or an alias, unknown ones are
+		// refused here rather than bounced later
+		if c.server.isLocalDomain(domain) {
+			targets, err := expandRecipient(c.server.Store, recip, nil)
+			ok := len(targets) > 0
+
+			if err == errMailLoop {
+				c.Write("554", "5.4.6 Alias loop for <"+recip+">")
+				c.logError("Alias loop for <%v>", recip)
+				return
+			}
+
+			if err != nil {
+				c.Write("451", "4.3.0 Temporary lookup failure, try again later")
+				c.logError("Recipient lookup for <%v> failed: %s", recip, err)
+				return
+			}
+
+			if !ok && !c.server.dropUnknown {
+				c.Write("550", "5.1.1 User unknown")
+				c.logWarn("Unknown recipient <%v>", recip)
+				return
+			}
+
+			if !ok {
+				c.dropped++
+				c.logInfo("Unknown recipient <%v>, dropping", recip)
+				c.Write("250", fmt.Sprintf("I'll make sure <%v> gets this", recip))
+				return
+			}
+		}
+
 		c.recipients = append(c.recipients, recip)
 		c.logInfo("Recipient: %v", recip)
 		c.Write("250", fmt.Sprintf("I'll make sure <%v> gets this", recip))
@@ -255,35 +327,70 @@ func (c *Client) authHandler(cmd string, arg string) {
 			return
 		}
 
-		c.logTrace("Got AUTH command, staying in MAIL state %s", arg)
+		if c.authUser != "" {
+			c.Write("503", "Already authenticated")
+			return
+		}
+
+		if !c.authAllowed() {
+			c.Write("538", "Encryption required for requested authentication mechanism")
+			return
+		}
+
+		if c.state == MAIL {
+			c.Write("503", "AUTH not permitted during a mail transaction")
+			return
+		}
+
 		parts := strings.Fields(arg)
 		mechanism := strings.ToUpper(parts[0])
+		initial := ""
 
-		/*
-		   scanner := bufio.NewScanner(c.bufin)
-		   line := scanner.Text()
-		   c.logTrace("Read Line %s", line)
+		// A single "=" stands for an empty initial response (RFC 4954)
+		if len(parts) > 1 && parts[1] != "=" {
+			initial = parts[1]
+		}
 
-		   if !scanner.Scan() {
-		     return
-		   }
-		*/
+		var user string
+		var err error
 
 		switch mechanism {
-		case "LOGIN":
-			c.Write("334", "VXNlcm5hbWU6")
 		case "PLAIN":
-			c.logInfo("Got PLAIN authentication: %s", mechanism)
-			c.Write("235", "Authentication successful")
+			user, err = c.authPlain(initial)
+		case "LOGIN":
+			user, err = c.authLogin(initial)
 		case "CRAM-MD5":
-			c.logInfo("Got CRAM-MD5 authentication, switching to AUTH state")
-			c.Write("334", "PDQxOTI5NDIzNDEuMTI4Mjg0NzJAc291cmNlZm91ci5hbmRyZXcuY211LmVkdT4=")
-		case "EXTERNAL":
-			c.logInfo("Got EXTERNAL authentication: %s", strings.TrimPrefix(arg, "EXTERNAL "))
-			c.Write("235", "Authentication successful")
+			if !c.server.cramMD5 {
+				c.Write("504", "Unsupported authentication mechanism")
+				return
+			}
+
+			if initial != "" {
+				c.Write("501", "CRAM-MD5 does not accept an initial response")
+				return
+			}
+
+			user, err = c.authCramMD5()
 		default:
 			c.logTrace("Unsupported authentication mechanism %v", arg)
 			c.Write("504", "Unsupported authentication mechanism")
+			return
+		}
+
+		switch err {
+		case nil:
+			c.authUser = user
+			c.logInfo("Authenticated as <%s> using %s", user, mechanism)
+			c.Write("235", "Authentication successful")
+		case errAuthCancelled:
+			c.Write("501", "Authentication cancelled")
+		case errAuthInvalid:
+			c.errors++
+			c.logWarn("Authentication failed for <%s> using %s", user, mechanism)
+			c.Write("535", "Authentication credentials invalid")
+		default:
+			c.logWarn("Authentication exchange failed: %v", err)
+			c.Write("501", "Cannot decode authentication response")
 		}
 	} else {
 		c.ooSeq(cmd)
@@ -310,11 +417,15 @@ func (c *Client) tlsHandler() {
 	err := tlsConn.Handshake()
 
 	if err == nil {
+		c.tlsConn = tlsConn
 		c.conn = tlsConn
 		c.bufin = bufio.NewReader(c.conn)
 		c.bufout = bufio.NewWriter(c.conn)
 		c.tls_on = true
 
+		// Discard any identity established before the TLS negotiation
+		c.authUser = ""
+
 		// Reset envelope as a new EHLO/HELO is required after STARTTLS
 		c.reset()
 
@@ -339,7 +450,7 @@ func (c *Client) dataHandler(cmd string, arg string) {
 		return
 	}
 
-	if len(c.recipients) > 0 {
+	if len(c.recipients) > 0 || c.dropped > 0 {
 		// We have recipients, go to accept data
 		c.logTrace("Go ahead we have recipients %d", len(c.recipients))
 		c.Write("354", "Go ahead, end your data with <CR><LF>.<CR><LF>")
@@ -398,7 +509,18 @@ func (c *Client) processData() {
 
 	if len(msg) > 0 {
 		c.logTrace("Got EOF, storing message and switching to MAIL state")
-		msg = strings.TrimSuffix(msg, "\r\n.\r\n")
+		// Strip the end of data marker, keeping the CRLF of the last line
+		if strings.HasSuffix(msg, "\r\n.\r\n") {
+			msg = msg[:len(msg)-3]
+		}
+
+		// Remove the transparency dots added by the client (RFC 5321 4.5.2)
+		msg = strings.Replace(msg, "\r\n..", "\r\n.", -1)
+
+		if strings.HasPrefix(msg, "..") {
+			msg = msg[1:]
+		}
+
 		c.data = msg
 		r, _ := regexp.Compile(c.server.SpamRegex)
 
@@ -411,7 +533,14 @@ func (c *Client) processData() {
 			return
 		}
 
-		if c.server.storeMessages {
+		if len(c.recipients) == 0 {
+			// Only unknown recipients which are dropped
+			c.Write("250", "Mail accepted")
+			c.logInfo("Message for unknown recipients dropped, size %v bytes", len(msg))
+		} else if hops := len(headerValues(msg, "Received")); hops > maxHops {
+			c.Write("554", "5.4.6 Too many hops, mail loop?")
+			c.logWarn("Message with %v hops refused", hops)
+		} else if c.server.storeMessages {
 			// Create message structure
 			mc := &config.SMTPMessage{}
 			mc.Helo = c.helo
@@ -420,7 +549,8 @@ func (c *Client) processData() {
 			mc.Data = c.data
 			mc.Host = c.remoteHost
 			mc.Domain = c.server.domain
-			mc.Notify = make(chan int)
+			// Buffered, the result may come after we gave up waiting
+			mc.Notify = make(chan int, 1)
 
 			// Process to send mail channel
 			c.server.Mailer.SendMailChan <- mc
@@ -431,6 +561,9 @@ func (c *Client) processData() {
 				if status == 1 {
 					c.Write("250", "Ok: queued as "+mc.Hash)
 					c.logInfo("Message size %v bytes", len(msg))
+				} else if status == -2 {
+					c.Write("451", "4.3.0 Temporary lookup failure, try again later")
+					c.logError("Recipient lookup failed, message not saved")
 				} else {
 					c.Write("554", "Error: transaction failed, blame it on the weather")
 					c.logError("Message save failed")
@@ -448,6 +581,22 @@ func (c *Client) processData() {
 	c.reset()
 }
 
+// isSubmission returns true if the session came in on a submission listener
+func (c *Client) isSubmission() bool {
+	return c.mode == SUBMISSION || c.mode == SMTPS
+}
+
+// authAllowed returns true if AUTH may be offered to the session, submission
+// listeners only allow it over TLS
+func (c *Client) authAllowed() bool {
+	return !c.isSubmission() || c.tls_on
+}
+
+// canRelay returns true if the session may send to remote domains
+func (c *Client) canRelay() bool {
+	return c.trusted || c.authUser != ""
+}
+
 func (c *Client) enterState(state State) {
 	c.state = state
 }
@@ -546,7 +695,7 @@ func (c *Client) parseArgs(arg string) (args map[string]string, ok bool) {
 	pm := re.FindAllStringSubmatch(arg, -1)
 
 	if pm == nil {
-		c.logWarn("Failed to parse arg string: %q")
+		c.logWarn("Failed to parse arg string: %q", arg)
 		return nil, false
 	}
 
@@ -563,6 +712,7 @@ func (c *Client) reset() {
 	c.from = ""
 	c.helo = ""
 	c.recipients = nil
+	c.dropped = 0
 }
 
 func (c *Client) ooSeq(cmd string) {
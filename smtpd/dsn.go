@@ -0,0 +1,179 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+// DSN actions (RFC 3464 2.3.3)
+const (
+	dsnFailed  = "failed"
+	dsnDelayed = "delayed"
+)
+
+var (
+	// Enhanced status code at the start of an SMTP reply text (RFC 3463)
+	enhancedCodeRegex = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\b`)
+
+	// An SMTP reply as returned by textproto.Error
+	smtpReplyRegex = regexp.MustCompile(`^[245]\d\d `)
+)
+
+// dsnStatus returns the RFC 3463 status code of a failed delivery attempt,
+// the one of the remote reply if it has one
+func dsnStatus(err error) string {
+	switch e := err.(type) {
+	case *textproto.Error:
+		if m := enhancedCodeRegex.FindStringSubmatch(e.Msg); m != nil {
+			return m[1]
+		}
+
+		return fmt.Sprintf("%d.0.0", e.Code/100)
+	case permanentError:
+		return e.status
+	}
+
+	// No answer from the host, or no host to ask
+	return "4.4.1"
+}
+
+// diagnostic returns the text of a failed delivery attempt, remote replies
+// as sent by the server. The lines of a multi-line reply are joined, the text
+// goes in a header field and in one line of the notification.
+func diagnostic(err error) string {
+	text := err.Error()
+
+	if e, ok := err.(*textproto.Error); ok {
+		text = fmt.Sprintf("%03d %s", e.Code, e.Msg)
+	}
+
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// newDSN returns a delivery status notification (RFC 3464) from the mail
+// system of domain to the sender of q about recipients. Action is dsnFailed
+// for bounces or dsnDelayed for warnings, retryUntil is when a delayed
+// message is given up. The original headers are returned, not the body.
+func newDSN(domain string, q *data.QueuedMessage, recipients []data.QueuedRecipient, action string, retryUntil time.Time) string {
+	now := time.Now()
+	boundary := fmt.Sprintf("%s.%d/%s", q.Id.Hex(), now.Unix(), domain)
+	subject := "Undelivered Mail Returned to Sender"
+
+	if action == dsnDelayed {
+		subject = "Delayed Mail (still being retried)"
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(b, "To: <%s>\r\n", q.From)
+	fmt.Fprintf(b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(b, "Message-ID: <%s.%d.dsn@%s>\r\n", q.Id.Hex(), now.UnixNano(), domain)
+	fmt.Fprintf(b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(b, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(b, "\r\nThis is a MIME-encapsulated message.\r\n\r\n")
+
+	// Human readable part
+	fmt.Fprintf(b, "--%s\r\n", boundary)
+	fmt.Fprintf(b, "Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	fmt.Fprintf(b, "This is the mail delivery system at %s.\r\n\r\n", domain)
+
+	if action == dsnDelayed {
+		fmt.Fprintf(b, "Your message could not be delivered yet to the recipients below.\r\n")
+		fmt.Fprintf(b, "Delivery will be retried until %s,\r\n", retryUntil.Format(time.RFC1123Z))
+		fmt.Fprintf(b, "you do not need to send it again.\r\n\r\n")
+	} else {
+		fmt.Fprintf(b, "Your message could not be delivered to the recipients below.\r\n\r\n")
+	}
+
+	for _, r := range recipients {
+		fmt.Fprintf(b, "<%s>: %s\r\n", r.Address, dsnReason(r, action))
+	}
+
+	// Machine readable part
+	fmt.Fprintf(b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(b, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(b, "Reporting-MTA: dns; %s\r\n", domain)
+	fmt.Fprintf(b, "Arrival-Date: %s\r\n", q.CreatedAt.Format(time.RFC1123Z))
+
+	for _, r := range recipients {
+		fmt.Fprintf(b, "\r\n")
+		fmt.Fprintf(b, "Final-Recipient: rfc822; %s\r\n", r.Address)
+
+		if !strings.EqualFold(r.Original, r.Address) {
+			fmt.Fprintf(b, "Original-Recipient: rfc822; %s\r\n", r.Original)
+		}
+
+		fmt.Fprintf(b, "Action: %s\r\n", action)
+		fmt.Fprintf(b, "Status: %s\r\n", dsnRecipientStatus(r, action))
+
+		if smtpReplyRegex.MatchString(r.LastError) {
+			fmt.Fprintf(b, "Diagnostic-Code: smtp; %s\r\n", r.LastError)
+		} else if r.LastError != "" {
+			fmt.Fprintf(b, "Diagnostic-Code: X-Surelin; %s\r\n", r.LastError)
+		}
+
+		fmt.Fprintf(b, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+
+		if action == dsnDelayed {
+			fmt.Fprintf(b, "Will-Retry-Until: %s\r\n", retryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	// Headers of the original message
+	fmt.Fprintf(b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(b, "Content-Type: text/rfc822-headers\r\n\r\n")
+	fmt.Fprintf(b, "%s", messageHeaders(q.Data))
+	fmt.Fprintf(b, "\r\n--%s--\r\n", boundary)
+
+	return b.String()
+}
+
+// dsnRecipientStatus returns the status of r for a notification, required
+// (RFC 3464 2.3.4) even if no attempt was made yet, for recipients held back
+// by the limits of their destination. A failed recipient has a permanent
+// status, even if the last reply was a temporary one.
+func dsnRecipientStatus(r data.QueuedRecipient, action string) string {
+	switch {
+	case action == dsnFailed && strings.HasPrefix(r.DsnStatus, "4."):
+		return "5" + r.DsnStatus[1:]
+	case r.DsnStatus != "":
+		return r.DsnStatus
+	case action == dsnDelayed:
+		return "4.4.7"
+	}
+
+	return "5.0.0"
+}
+
+// dsnReason returns the human readable reason r is in a notification
+func dsnReason(r data.QueuedRecipient, action string) string {
+	switch {
+	case r.LastError != "":
+		return r.LastError
+	case action == dsnDelayed:
+		return "not attempted yet, the destination is busy"
+	}
+
+	return "delivery failed"
+}
+
+// messageHeaders returns the header section of msg, ending with a line break
+func messageHeaders(msg string) string {
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		return msg[:i+2]
+	}
+
+	if !strings.HasSuffix(msg, "\r\n") {
+		msg += "\r\n"
+	}
+
+	return msg
+}
@@ -0,0 +1,67 @@
+package smtpd
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+func TestDSNWithoutAttempt(t *testing.T) {
+	q := data.NewQueuedMessage("alice@example.com", "Subject: hi\r\n\r\nhi\r\n")
+	q.AddRecipient("bob@remote.org", "bob@remote.org")
+
+	tests := []struct {
+		action string
+		status string
+	}{
+		{dsnDelayed, "Status: 4.4.7\r\n"},
+		{dsnFailed, "Status: 5.0.0\r\n"},
+	}
+
+	for _, tt := range tests {
+		dsn := newDSN("example.com", q, q.Recipients, tt.action, time.Now())
+
+		if !strings.Contains(dsn, tt.status) {
+			t.Errorf("%s notification without %q", tt.action, tt.status)
+		}
+
+		if strings.Contains(dsn, "<bob@remote.org>: \r\n") {
+			t.Errorf("%s notification without a reason", tt.action)
+		}
+
+		if strings.Contains(dsn, "Diagnostic-Code:") {
+			t.Errorf("%s notification with a diagnostic but no reply", tt.action)
+		}
+	}
+}
+
+func TestDSNFailedRecipient(t *testing.T) {
+	q := data.NewQueuedMessage("alice@example.com", "Subject: hi\r\n\r\nhi\r\n")
+	q.AddRecipient("bob@remote.org", "bob@remote.org")
+
+	// A multi-line reply ends up on one line
+	err := &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full\nTry again later"}
+	r := &q.Recipients[0]
+	r.Status = data.QueueFailed
+	r.LastError = diagnostic(err)
+	r.DsnStatus = dsnStatus(err)
+
+	dsn := newDSN("example.com", q, q.Recipients, dsnFailed, time.Now())
+
+	for _, want := range []string{
+		"<bob@remote.org>: 452 4.2.2 Mailbox full Try again later\r\n",
+		"Diagnostic-Code: smtp; 452 4.2.2 Mailbox full Try again later\r\n",
+		"Status: 5.2.2\r\n",
+	} {
+		if !strings.Contains(dsn, want) {
+			t.Errorf("Notification without %q", want)
+		}
+	}
+
+	if strings.Contains(strings.Replace(dsn, "\r\n", "", -1), "\n") {
+		t.Error("Notification with a bare line feed")
+	}
+}
@@ -4,7 +4,10 @@ import (
   "fmt"
   "net"
   "net/smtp"
-  "strings"
+  "net/textproto"
+  "strconv"
+  "sync"
+  "time"
 
   "github.com/fitraditya/surelin-smtpd/config"
   "github.com/fitraditya/surelin-smtpd/data"
@@ -12,108 +15,528 @@ import (
 )
 
 var (
-  ports = []int{25, 2525, 587}
+  // Port mail exchangers listen on (RFC 5321 2.3.5)
+  smtpPort = 25
+
+  // How long to wait for a mail exchanger to accept the connection
+  dialTimeout = 30 * time.Second
 )
 
 type Mailer struct {
   Config          config.SmtpConfig
   Store           *data.DataStore
+  Resolver        Resolver
   SendMailChan    chan *config.SMTPMessage
   NotifyMailChan  chan interface{}
+
+  // Queued messages due for delivery, and the ones being delivered so the
+  // queue scan does not hand them out twice
+  queueChan       chan *data.QueuedMessage
+  mu              sync.Mutex
+  active          map[string]bool
+
+  // Idle sessions by destination, reused for the next message, and the
+  // load on each destination for its limits
+  poolMu          sync.Mutex
+  pool            map[string][]*session
+  loads           map[string]*destLoad
+}
+
+// permanentError is a delivery failure which retrying will not fix, with
+// its RFC 3463 status code
+type permanentError struct {
+  error
+  status string
 }
 
 func NewMailer(ds *data.DataStore) *Mailer {
   cfg := config.GetSmtpConfig()
   sendMailChan := make(chan *config.SMTPMessage, 256)
   notifyMailChan := make(chan interface{}, 256)
-  return &Mailer{Config: cfg, Store: ds, SendMailChan: sendMailChan, NotifyMailChan: notifyMailChan}
+  queueChan := make(chan *data.QueuedMessage, 256)
+  return &Mailer{Config: cfg, Store: ds, Resolver: DNSResolver{}, SendMailChan: sendMailChan, NotifyMailChan: notifyMailChan, queueChan: queueChan, active: make(map[string]bool), pool: make(map[string][]*session), loads: make(map[string]*destLoad)}
 }
 
 func (md *Mailer) Start() {
-  // Start some mailer daemon
-  for i := 0; i < 3; i++ {
+  // Start the mailer daemons
+  for i := 0; i < md.Config.QueueWorkers; i++ {
     go md.SendMail(i)
   }
+
+  // Start the delivery workers and the queue scan
+  for i := 0; i < md.Config.QueueWorkers; i++ {
+    go md.Deliver(i)
+  }
+
+  go md.RunQueue()
 }
 
+// SendMail takes messages accepted by the SMTP server, stores the copies for
+// local recipients and puts the remote ones in the outbound queue. Notify
+// gets 1 once the message is ours, -2 if a recipient lookup failed and the
+// client may try again, -1 otherwise. Recipients in a forwarding loop are
+// bounced.
 func (md *Mailer) SendMail(id int) {
   log.LogTrace("Running Mailer Daemon #<%d>", id)
 
   for {
     mc := <-md.SendMailChan
+    local := make([]string, 0)
+    loops := deliveredTo(mc.Data)
+    q := data.NewQueuedMessage(mc.From, mc.Data)
+    failed := make([]data.QueuedRecipient, 0)
+    lookupFailed := false
+
+    for _, rcpt := range mc.To {
+      // Aliases, forwards and catch-alls are expanded here
+      targets, err := expandRecipient(md.Store, rcpt, loops)
+
+      // Loops are only seen here, in the Delivered-To headers: retrying
+      // will not help, the sender gets a bounce for the recipient
+      if err == errMailLoop {
+        log.LogWarn("Mail forwarding loop for <%s>", rcpt)
+        failed = append(failed, data.QueuedRecipient{
+          Address:   rcpt,
+          Original:  rcpt,
+          Status:    data.QueueFailed,
+          LastError: errMailLoop.Error(),
+          DsnStatus: "5.4.6",
+        })
+        continue
+      }
+
+      if err != nil {
+        log.LogError("Cannot expand recipient <%s>: %s", rcpt, err)
+        lookupFailed = true
+        break
+      }
 
-    for i := range mc.To {
-      if strings.Contains(mc.To[i], md.Config.Domain) {
-        md.Store.SaveMailChan <- mc
-      } else {
-        if !strings.Contains(mc.To[i], "@") {
-          log.LogError("Invalid recipient address: <%s>", mc.To[i])
-          return
+      for _, to := range targets {
+        if md.Store.IsLocalDomain(data.DomainOf(to)) {
+          local = appendAddress(local, to)
+        } else {
+          q.AddRecipient(to, rcpt)
         }
+      }
+    }
 
-        host := strings.Split(mc.To[i], "@")[1]
-        addr, err := net.LookupMX(host)
+    // Nothing is saved yet, the client sends the message again later
+    if lookupFailed {
+      mc.Notify <- -2
+      continue
+    }
 
-        if err != nil {
-          log.LogError("Cannot not lookup host: <%s>", addr)
-          return
-        }
+    // Only looping recipients, the client gets the error instead of a bounce
+    if len(failed) > 0 && len(local) == 0 && len(q.Recipients) == 0 {
+      mc.Notify <- -1
+      continue
+    }
 
-        c, err := newClient(addr, ports)
+    // Local recipients first: if their copy is not saved the client sends
+    // the message again, so nothing may be queued for the remote ones yet
+    if len(local) > 0 && !md.saveLocal(mc, local) {
+      mc.Notify <- -1
+      continue
+    }
 
-        if err != nil {
-          log.LogError("Cannot not create SMTP client")
-          return
-        }
+    if len(q.Recipients) > 0 {
+      // The message is ours once it is in the queue, if that fails the
+      // client has to try again
+      if err := md.Store.Storage.StoreQueued(q); err != nil {
+        log.LogError("Cannot queue message: %s", err)
+        mc.Notify <- -1
+        continue
+      }
 
-        err = send(c, mc.From, mc.To[i], mc.Data)
+      log.LogInfo("Queued message <%s> for %d remote recipients", q.Id.Hex(), len(q.Recipients))
+      md.schedule(q)
 
-        if err != nil {
-          log.LogError("Cannot not send message")
-          return
-        }
+      if len(local) == 0 {
+        mc.Hash = q.Id.Hex()
+      }
+    }
+
+    mc.Notify <- 1
+
+    // Not from this goroutine, it reads the channel the bounce goes to
+    if len(failed) > 0 {
+      go md.bounce(q, failed, dsnFailed)
+    }
+  }
+}
+
+// saveLocal stores the copy of mc for the local recipients, which share one
+// stored message, and waits for the result. It returns false if the copy
+// was not saved.
+func (md *Mailer) saveLocal(mc *config.SMTPMessage, local []string) bool {
+  lc := *mc
+  lc.To = local
+  lc.Notify = make(chan int, 1)
+  md.Store.SaveMailChan <- &lc
+
+  if <-lc.Notify != 1 {
+    return false
+  }
+
+  mc.Hash = lc.Hash
+  return true
+}
+
+// RunQueue hands the queued messages which are due to the delivery workers,
+// at start and then every queue interval, so messages queued before a
+// restart are picked up again
+func (md *Mailer) RunQueue() {
+  log.LogTrace("Running Queue Daemon, every %v", md.Config.QueueInterval)
+  tick := time.NewTicker(md.Config.QueueInterval)
+  defer tick.Stop()
+
+  for {
+    queue, err := md.Store.Storage.ListQueue(time.Now())
 
-        mc.Notify <- 1
+    if err != nil {
+      log.LogError("Cannot scan the queue: %s", err)
+    }
+
+    for i := range queue {
+      md.schedule(&queue[i])
+    }
+
+    <-tick.C
+    md.closeIdle()
+  }
+}
+
+// schedule passes q to a delivery worker unless one has it already. If all
+// workers are busy it is left for the next queue scan.
+func (md *Mailer) schedule(q *data.QueuedMessage) {
+  id := q.Id.Hex()
+
+  md.mu.Lock()
+  defer md.mu.Unlock()
+
+  if md.active[id] {
+    return
+  }
+
+  select {
+  case md.queueChan <- q:
+    md.active[id] = true
+  default:
+  }
+}
+
+// Deliver is a delivery worker, failures are kept in the queue and never
+// stop the worker
+func (md *Mailer) Deliver(id int) {
+  log.LogTrace("Running Delivery Daemon #<%d>", id)
+
+  for q := range md.queueChan {
+    // The scan may have read q before another worker updated it
+    if cur, err := md.Store.Storage.LoadQueued(q.Id.Hex()); err != nil {
+      log.LogTrace("Queued message <%s> is gone: %s", q.Id.Hex(), err)
+    } else if !cur.NextAttempt.After(time.Now()) {
+      md.attempt(cur)
+    }
+
+    md.mu.Lock()
+    delete(md.active, q.Id.Hex())
+    md.mu.Unlock()
+  }
+}
+
+// attempt tries the pending recipients of q once. Recipients refused with a
+// permanent error are failed, the others are retried with a growing delay
+// until the queue lifetime is over. The sender gets a bounce for the failed
+// ones and, if configured, a warning when delivery takes long.
+func (md *Mailer) attempt(q *data.QueuedMessage) {
+  defer func() {
+    if r := recover(); r != nil {
+      log.LogError("Delivery of <%s> panicked: %v", q.Id.Hex(), r)
+    }
+  }()
+
+  pending := make([]int, 0)
+
+  for i, r := range q.Recipients {
+    if r.Status == data.QueuePending {
+      pending = append(pending, i)
+    }
+  }
+
+  // Recipients sharing a destination go in one transaction. Batches held
+  // back by the limits of their destination are not an attempt, they are
+  // tried again as soon as the limits allow.
+  tried := false
+  var throttled time.Duration
+
+  for _, b := range md.batches(q) {
+    if wait := md.deliverBatch(q, b); wait == 0 {
+      tried = true
+    } else if throttled == 0 || wait < throttled {
+      throttled = wait
+    }
+  }
+
+  failed := make([]data.QueuedRecipient, 0)
+
+  for _, i := range pending {
+    if q.Recipients[i].Status == data.QueueFailed {
+      failed = append(failed, q.Recipients[i])
+    }
+  }
+
+  if tried {
+    q.Attempts++
+  }
+
+  if q.Pending() > 0 && time.Since(q.CreatedAt) > md.Config.QueueLifetime {
+    for i := range q.Recipients {
+      if r := &q.Recipients[i]; r.Status == data.QueuePending {
+        // Delivery time expired (RFC 3463), the last reply is kept
+        r.Status = data.QueueFailed
+        r.DsnStatus = "5.4.7"
+        failed = append(failed, *r)
+        log.LogWarn("Delivery of <%s> to <%s> expired after %d attempts", q.Id.Hex(), r.Address, q.Attempts)
       }
     }
   }
+
+  if len(failed) > 0 {
+    md.bounce(q, failed, dsnFailed)
+  }
+
+  if q.Pending() > 0 && !q.Warned && md.Config.QueueDelayWarning > 0 && time.Since(q.CreatedAt) >= md.Config.QueueDelayWarning {
+    delayed := make([]data.QueuedRecipient, 0)
+
+    for _, r := range q.Recipients {
+      if r.Status == data.QueuePending {
+        delayed = append(delayed, r)
+      }
+    }
+
+    md.bounce(q, delayed, dsnDelayed)
+    q.Warned = true
+  }
+
+  if q.Pending() == 0 {
+    if err := md.Store.Storage.DeleteQueued(q.Id.Hex()); err != nil {
+      log.LogError("Cannot remove <%s> from the queue: %s", q.Id.Hex(), err)
+    }
+
+    return
+  }
+
+  next := md.backoff(q.Attempts)
+
+  if throttled > 0 && throttled < next {
+    next = throttled
+  }
+
+  q.NextAttempt = time.Now().Add(next)
+
+  if err := md.Store.Storage.StoreQueued(q); err != nil {
+    log.LogError("Cannot update <%s> in the queue: %s", q.Id.Hex(), err)
+  }
+}
+
+// record sets the status of recipient i of q after a delivery attempt with
+// the result err
+func (md *Mailer) record(q *data.QueuedMessage, i int, tlsInfo string, err error) {
+  r := &q.Recipients[i]
+  r.TLS = tlsInfo
+
+  switch {
+  case err == nil:
+    r.Status = data.QueueSent
+    r.LastError = ""
+
+    if tlsInfo == "" {
+      tlsInfo = "plaintext"
+    }
+
+    log.LogInfo("Delivered <%s> to <%s> (%s)", q.Id.Hex(), r.Address, tlsInfo)
+  case isPermanent(err):
+    r.Status = data.QueueFailed
+    r.LastError = diagnostic(err)
+    r.DsnStatus = dsnStatus(err)
+    log.LogWarn("Delivery of <%s> to <%s> failed: %s", q.Id.Hex(), r.Address, err)
+  default:
+    r.LastError = diagnostic(err)
+    r.DsnStatus = dsnStatus(err)
+    log.LogWarn("Delivery of <%s> to <%s> deferred: %s", q.Id.Hex(), r.Address, err)
+  }
+}
+
+// bounce tells the sender of q about recipients with a delivery status
+// notification. It goes through SendMail like any other message, so local
+// senders get it in their mailbox and remote ones through the queue. Bounces
+// themselves have no sender and are never bounced.
+func (md *Mailer) bounce(q *data.QueuedMessage, recipients []data.QueuedRecipient, action string) {
+  if q.From == "" {
+    log.LogWarn("Bounce <%s> not delivered to %d recipients, dropped", q.Id.Hex(), len(recipients))
+    return
+  }
+
+  mc := &config.SMTPMessage{}
+  mc.Helo = md.Config.Domain
+  mc.From = ""
+  mc.To = []string{q.From}
+  mc.Data = newDSN(md.Config.Domain, q, recipients, action, q.CreatedAt.Add(md.Config.QueueLifetime))
+  mc.Host = "127.0.0.1"
+  mc.Domain = md.Config.Domain
+
+  // Nobody waits for the result
+  mc.Notify = make(chan int, 1)
+
+  log.LogInfo("Sending %s notification for <%s> to <%s>", action, q.Id.Hex(), q.From)
+  md.SendMailChan <- mc
+}
+
+// backoff returns the delay after the given number of failed attempts, the
+// minimum retry delay doubled for every attempt after the first, at most the
+// maximum retry delay
+func (md *Mailer) backoff(attempts int) time.Duration {
+  d := md.Config.QueueRetryMin
+
+  for i := 1; i < attempts && d < md.Config.QueueRetryMax; i++ {
+    d *= 2
+  }
+
+  if d > md.Config.QueueRetryMax {
+    d = md.Config.QueueRetryMax
+  }
+
+  return d
+}
+
+// isPermanent returns true if err is a 5xx reply or a failure retrying will
+// not fix, everything else (4xx, network, DNS) is deferred
+func isPermanent(err error) bool {
+  switch e := err.(type) {
+  case *textproto.Error:
+    return e.Code >= 500
+  case permanentError:
+    return true
+  }
+
+  return false
+}
+
+// connect opens a session for mail to domain: through the relay host routed
+// to, or with the mail exchangers of the domain and STARTTLS as its TLS
+// policy asks. It returns the negotiated TLS parameters, or "" if the
+// session is in plaintext.
+func (md *Mailer) connect(domain string) (*smtp.Client, string, error) {
+  if r := md.route(domain); r != nil {
+    return md.connectRelay(r)
+  }
+
+  mx, err := md.lookupMX(domain)
+
+  if err != nil {
+    return nil, "", err
+  }
+
+  c, host, addr, err := md.newClient(mx, smtpPort)
+
+  if err != nil {
+    return nil, "", err
+  }
+
+  return md.upgrade(c, addr, host, md.tlsPolicy(domain))
 }
 
-func newClient(mx []*net.MX, ports []int) (*smtp.Client, error) {
-  for i := range mx {
-    for j := range ports {
-      server := strings.TrimSuffix(mx[i].Host, ".")
-      hostPort := fmt.Sprintf("%s:%d", server, ports[j])
-      client, err := smtp.Dial(hostPort)
+// newClient connects to the mail exchangers of mx in order, every address of
+// each, and greets the first answering. It returns the session, the name of
+// the exchanger and the address it is connected to. If exchangers answered
+// but refused us, the last refusal is the error.
+func (md *Mailer) newClient(mx []*net.MX, port int) (*smtp.Client, string, string, error) {
+  hosts := make([]string, 0, len(mx))
+  var refused error
+
+  for _, m := range mx {
+    hosts = append(hosts, m.Host)
+    addrs, err := md.Resolver.LookupHost(m.Host)
+
+    if err != nil {
+      log.LogTrace("Cannot lookup MX host %s: %s", m.Host, err)
+      continue
+    }
+
+    for _, a := range addrs {
+      addr := net.JoinHostPort(a, strconv.Itoa(port))
+      c, err := dial(addr, m.Host, md.Config.Domain)
 
       if err != nil {
-        if j == len(ports)-1 {
-          return nil, fmt.Errorf("Couldn't connect to servers %v on port %d", mx, ports[j])
+        log.LogTrace("Cannot connect to %s (%s): %s", m.Host, addr, err)
+
+        if _, ok := err.(*textproto.Error); ok {
+          refused = err
         }
 
         continue
       }
 
-      return client, nil
+      return c, m.Host, addr, nil
     }
   }
 
-  return nil, fmt.Errorf("Couldn't connect to servers %v on any common port", mx)
+  if refused != nil {
+    return nil, "", "", refused
+  }
+
+  return nil, "", "", fmt.Errorf("Couldn't connect to mail exchangers %v on port %d", hosts, port)
 }
 
-func send(c *smtp.Client, from string, to string, msg string) error {
+// dial opens an SMTP session with the server host at addr and greets it as
+// helo, so its extensions are known
+func dial(addr string, host string, helo string) (*smtp.Client, error) {
+  conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+
+  if err != nil {
+    return nil, err
+  }
+
+  c, err := smtp.NewClient(conn, host)
+
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  if err := c.Hello(helo); err != nil {
+    c.Close()
+    return nil, err
+  }
+
+  return c, nil
+}
+
+// send runs one mail transaction for the recipients to. A recipient refused
+// at RCPT gets its own error in errs, the others share err, the result of the
+// transaction. If no recipient is accepted no data is sent.
+func send(c *smtp.Client, from string, to []string, msg string) (errs []error, err error) {
   if err := c.Mail(from); err != nil {
-    return err
+    return nil, err
   }
 
-  if err := c.Rcpt(to); err != nil {
-    return err
+  errs = make([]error, len(to))
+  accepted := 0
+
+  for i := range to {
+    if errs[i] = c.Rcpt(to[i]); errs[i] == nil {
+      accepted++
+    }
+  }
+
+  if accepted == 0 {
+    return errs, c.Reset()
   }
 
   m, err := c.Data()
 
   if err != nil {
-    return err
+    return errs, err
   }
 
   /*
@@ -145,20 +568,9 @@ func send(c *smtp.Client, from string, to string, msg string) error {
   _, err = fmt.Fprint(m, msg)
 
   if err != nil {
-    return err
-  }
-
-  err = m.Close()
-
-  if err != nil {
-    return err
-  }
-
-  err = c.Quit()
-
-  if err != nil {
-    return err
+    return errs, err
   }
 
-  return nil
+  // The session stays open for the next transaction
+  return errs, m.Close()
 }
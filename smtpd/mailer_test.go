@@ -0,0 +1,163 @@
+package smtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+func TestSendMailSavesLocalCopyFirst(t *testing.T) {
+	for _, saved := range []int{1, -1} {
+		ds := newTestStore(t)
+		md := &Mailer{Store: ds, SendMailChan: make(chan *config.SMTPMessage, 1), active: make(map[string]bool)}
+		go md.SendMail(0)
+
+		// The local save answers with saved
+		go func() {
+			mc := <-ds.SaveMailChan
+			mc.Hash = "local"
+			mc.Notify <- saved
+		}()
+
+		mc := &config.SMTPMessage{
+			From:   "carol@remote.org",
+			To:     []string{"alice@example.com", "bob@remote.org"},
+			Data:   "Subject: hi\r\n\r\nhi\r\n",
+			Notify: make(chan int, 1),
+		}
+
+		md.SendMailChan <- mc
+
+		select {
+		case status := <-mc.Notify:
+			if status != saved {
+				t.Errorf("Local save %d, client told %d", saved, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No answer for the client")
+		}
+
+		queue, err := ds.Storage.ListQueue(time.Now())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := map[int]int{1: 1, -1: 0}[saved]; len(queue) != want {
+			t.Errorf("Local save %d, %d messages queued, want %d", saved, len(queue), want)
+		}
+	}
+}
+
+// failingAliases is a storage whose alias lookups fail
+type failingAliases struct {
+	data.Storage
+}
+
+func (s failingAliases) LoadAlias(address string) (*data.Alias, error) {
+	return nil, errors.New("Storage unavailable")
+}
+
+// sendMail hands mc to a running SendMail, the local saves succeed, and
+// returns the answer for the client
+func sendMail(t *testing.T, md *Mailer, mc *config.SMTPMessage) int {
+	go func() {
+		for lc := range md.Store.SaveMailChan {
+			lc.Notify <- 1
+		}
+	}()
+
+	t.Cleanup(func() { close(md.Store.SaveMailChan) })
+	mc.Notify = make(chan int, 1)
+	md.SendMailChan <- mc
+
+	select {
+	case status := <-mc.Notify:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("No answer for the client")
+	}
+
+	return 0
+}
+
+func TestSendMailLoopingRecipient(t *testing.T) {
+	md := &Mailer{Store: newAliasStore(t), SendMailChan: make(chan *config.SMTPMessage, 4), active: make(map[string]bool)}
+	md.Config.Domain = "example.com"
+	md.Config.QueueLifetime = 120 * time.Hour
+	go md.SendMail(0)
+
+	msg := "Delivered-To: team@example.com\r\nSubject: hi\r\n\r\nhi\r\n"
+	mc := &config.SMTPMessage{From: "carol@remote.org", To: []string{"team@example.com", "alice@example.com"}, Data: msg}
+
+	if status := sendMail(t, md, mc); status != 1 {
+		t.Fatalf("Client told %d, want 1", status)
+	}
+
+	// The only message queued is the bounce for team@example.com, it is
+	// queued by SendMail itself
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		queue, err := md.Store.Storage.ListQueue(time.Now())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(queue) > 0 {
+			q := queue[0]
+
+			if len(queue) != 1 || q.From != "" || q.Recipients[0].Address != "carol@remote.org" {
+				t.Fatalf("Queue has %+v, want a bounce to the sender", queue)
+			}
+
+			if !strings.Contains(q.Data, "Final-Recipient: rfc822; team@example.com") || !strings.Contains(q.Data, "Status: 5.4.6") {
+				t.Errorf("Bounce is\n%s", q.Data)
+			}
+
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("No bounce for the looping recipient")
+}
+
+func TestSendMailNotSaved(t *testing.T) {
+	tests := []struct {
+		name   string
+		ds     func(t *testing.T) *data.DataStore
+		data   string
+		status int
+	}{
+		{"looping recipient only", newAliasStore, "Delivered-To: team@example.com\r\n\r\nhi\r\n", -1},
+		{"alias lookup failure", func(t *testing.T) *data.DataStore {
+			ds := newTestStore(t)
+			ds.Storage = failingAliases{ds.Storage}
+			return ds
+		}, "Subject: hi\r\n\r\nhi\r\n", -2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := &Mailer{Store: tt.ds(t), SendMailChan: make(chan *config.SMTPMessage, 4), active: make(map[string]bool)}
+			go md.SendMail(0)
+
+			mc := &config.SMTPMessage{From: "carol@remote.org", To: []string{"team@example.com"}, Data: tt.data}
+
+			if status := sendMail(t, md, mc); status != tt.status {
+				t.Errorf("Client told %d, want %d", status, tt.status)
+			}
+
+			if queue, _ := md.Store.Storage.ListQueue(time.Now()); len(queue) != 0 {
+				t.Errorf("%d messages queued, want none", len(queue))
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver looks up the names the mailer delivers to. Names which do not
+// exist or have no records of the asked type give a *net.DNSError with
+// IsNotFound set.
+type Resolver interface {
+	LookupMX(domain string) ([]*net.MX, error)
+	LookupHost(host string) ([]string, error)
+}
+
+// DNSResolver asks the DNS through the resolver of the system
+type DNSResolver struct{}
+
+func (DNSResolver) LookupMX(domain string) ([]*net.MX, error) {
+	return net.LookupMX(domain)
+}
+
+func (DNSResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+// StaticResolver answers from fixed tables, for tests and closed networks.
+// Names are lower case without the trailing dot.
+type StaticResolver struct {
+	MX    map[string][]*net.MX
+	Hosts map[string][]string
+}
+
+func (r StaticResolver) LookupMX(domain string) ([]*net.MX, error) {
+	if mx, ok := r.MX[staticName(domain)]; ok {
+		return mx, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func (r StaticResolver) LookupHost(host string) ([]string, error) {
+	if addrs, ok := r.Hosts[staticName(host)]; ok {
+		return addrs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func staticName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isNotFound returns true if err says a name has no records
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+// lookupMX returns the mail exchangers of domain by preference (RFC 5321
+// 5.1). A domain without MX records is its own mail exchanger if it has an
+// address, one with a null MX (RFC 7505) takes no mail at all.
+func (md *Mailer) lookupMX(domain string) ([]*net.MX, error) {
+	mx, err := md.Resolver.LookupMX(domain)
+
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("Cannot lookup MX of <%s>: %s", domain, err)
+	}
+
+	// Implicit MX
+	if len(mx) == 0 {
+		if _, err := md.Resolver.LookupHost(domain); isNotFound(err) {
+			return nil, permanentError{fmt.Errorf("Domain <%s> not found", domain), "5.1.2"}
+		} else if err != nil {
+			return nil, fmt.Errorf("Cannot lookup host <%s>: %s", domain, err)
+		}
+
+		return []*net.MX{{Host: domain, Pref: 0}}, nil
+	}
+
+	hosts := make([]*net.MX, 0, len(mx))
+
+	for _, m := range mx {
+		if h := strings.TrimSuffix(m.Host, "."); h != "" {
+			hosts = append(hosts, &net.MX{Host: h, Pref: m.Pref})
+		}
+	}
+
+	// Only "." left, the null MX
+	if len(hosts) == 0 {
+		return nil, permanentError{fmt.Errorf("Domain <%s> does not accept mail (null MX)", domain), "5.1.10"}
+	}
+
+	// Stable, exchangers of equal preference stay in the order of the
+	// resolver which shuffles them
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].Pref < hosts[j].Pref
+	})
+
+	return hosts, nil
+}
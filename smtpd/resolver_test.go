@@ -0,0 +1,222 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeServer is an SMTP server on 127.0.0.1 for the mailer to deliver to
+type fakeServer struct {
+	Port     int
+	Greeting string
+
+	// Reply to RCPT TO for an address, "250 OK" if nil
+	Rcpt func(address string) string
+
+	// Recipients of the accepted messages
+	Delivered chan []string
+}
+
+// startFakeServer runs a fakeServer until the end of the test
+func startFakeServer(t *testing.T, greeting string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeServer{
+		Port:      l.Addr().(*net.TCPAddr).Port,
+		Greeting:  greeting,
+		Delivered: make(chan []string, 16),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply(s.Greeting)
+
+	if !strings.HasPrefix(s.Greeting, "220") {
+		return
+	}
+
+	var to []string
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-fake.example.net")
+			reply("250 PIPELINING")
+		case strings.HasPrefix(cmd, "MAIL"), cmd == "RSET":
+			to = nil
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			address := strings.Trim(strings.TrimSpace(line)[8:], "<>")
+			answer := "250 OK"
+
+			if s.Rcpt != nil {
+				answer = s.Rcpt(address)
+			}
+
+			if strings.HasPrefix(answer, "250") {
+				to = append(to, address)
+			}
+
+			reply(answer)
+		case cmd == "DATA":
+			reply("354 Go ahead")
+
+			for {
+				if line, err = r.ReadString('\n'); err != nil || line == ".\r\n" {
+					break
+				}
+			}
+
+			s.Delivered <- to
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func TestLookupMX(t *testing.T) {
+	md := &Mailer{Resolver: StaticResolver{
+		MX: map[string][]*net.MX{
+			"example.net": {
+				{Host: "mx2.example.net.", Pref: 20},
+				{Host: "mx1.example.net.", Pref: 10},
+				{Host: "backup.example.net.", Pref: 20},
+			},
+			"null.example.net": {{Host: ".", Pref: 0}},
+		},
+		Hosts: map[string][]string{
+			"example.org": {"192.0.2.1"},
+		},
+	}}
+
+	tests := []struct {
+		domain string
+		hosts  []string
+		status string // Status of the permanent error, "" for none
+	}{
+		{"example.net", []string{"mx1.example.net", "mx2.example.net", "backup.example.net"}, ""},
+		{"example.org", []string{"example.org"}, ""},
+		{"null.example.net", nil, "5.1.10"},
+		{"missing.example.net", nil, "5.1.2"},
+	}
+
+	for _, tt := range tests {
+		mx, err := md.lookupMX(tt.domain)
+
+		if tt.status != "" {
+			if e, ok := err.(permanentError); !ok || e.status != tt.status {
+				t.Errorf("lookupMX(%s) returned %v, want permanent error %s", tt.domain, err, tt.status)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("lookupMX(%s) failed: %s", tt.domain, err)
+			continue
+		}
+
+		hosts := make([]string, 0, len(mx))
+
+		for _, m := range mx {
+			hosts = append(hosts, m.Host)
+		}
+
+		if strings.Join(hosts, " ") != strings.Join(tt.hosts, " ") {
+			t.Errorf("lookupMX(%s) returned %v, want %v", tt.domain, hosts, tt.hosts)
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	up := startFakeServer(t, "220 fake.example.net ESMTP")
+	busy := startFakeServer(t, "421 4.7.0 Too many connections")
+
+	// The fake servers listen on 127.0.0.1 only, 127.0.0.2 refuses
+	md := &Mailer{Resolver: StaticResolver{Hosts: map[string][]string{
+		"down.example.net": {"127.0.0.2"},
+		"up.example.net":   {"127.0.0.2", "127.0.0.1"},
+	}}}
+
+	mx := func(hosts ...string) []*net.MX {
+		list := make([]*net.MX, 0, len(hosts))
+
+		for i, h := range hosts {
+			list = append(list, &net.MX{Host: h, Pref: uint16(10 * i)})
+		}
+
+		return list
+	}
+
+	tests := []struct {
+		name string
+		mx   []*net.MX
+		port int
+		host string // Exchanger connected to, "" if none
+		code int    // Code of the refusal returned, 0 for none
+	}{
+		{"first exchanger", mx("up.example.net", "down.example.net"), up.Port, "up.example.net", 0},
+		{"next exchanger", mx("unknown.example.net", "down.example.net", "up.example.net"), up.Port, "up.example.net", 0},
+		{"none answering", mx("unknown.example.net", "down.example.net"), up.Port, "", 0},
+		{"refused", mx("up.example.net"), busy.Port, "", 421},
+	}
+
+	for _, tt := range tests {
+		c, host, addr, err := md.newClient(tt.mx, tt.port)
+
+		if c != nil {
+			c.Close()
+		}
+
+		if host != tt.host {
+			t.Errorf("%s: connected to %q (%s), want %q", tt.name, host, addr, tt.host)
+		}
+
+		if tt.host == "" && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+
+		if e, ok := err.(*textproto.Error); tt.code != 0 && (!ok || e.Code != tt.code) {
+			t.Errorf("%s: returned %v, want a %d reply", tt.name, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+)
+
+// route returns the relay host for mail to domain, or nil if it goes to the
+// mail exchangers of the domain
+func (md *Mailer) route(domain string) *config.Route {
+	r, ok := md.Config.Routes[strings.ToLower(domain)]
+
+	if !ok {
+		r = md.Config.Relayhost
+	}
+
+	if r == nil || r.Direct {
+		return nil
+	}
+
+	return r
+}
+
+// connectRelay opens a session with the relay host r, authenticated if it
+// has credentials. It returns the negotiated TLS parameters.
+func (md *Mailer) connectRelay(r *config.Route) (*smtp.Client, string, error) {
+	addr := net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+
+	var c *smtp.Client
+	var tlsInfo string
+	var err error
+
+	if r.ImplicitTLS {
+		c, tlsInfo, err = md.dialTLS(addr, r.Host, r.TLS)
+	} else if c, err = dial(addr, r.Host, md.Config.Domain); err == nil {
+		c, tlsInfo, err = md.upgrade(c, addr, r.Host, r.TLS)
+	}
+
+	// The relay telling us to slow down is kept as it is, so we do
+	if isBusy(err) {
+		return nil, "", err
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot connect to relay %s: %s", addr, err)
+	}
+
+	if r.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, "", fmt.Errorf("Relay %s does not offer AUTH", addr)
+		}
+
+		// A refused login is our configuration, the message is kept
+		if err := c.Auth(smtp.PlainAuth("", r.Username, r.Password, r.Host)); err != nil {
+			c.Close()
+			return nil, "", fmt.Errorf("Authentication with relay %s failed: %s", addr, err)
+		}
+	}
+
+	return c, tlsInfo, nil
+}
+
+// dialTLS opens an SMTP session over implicit TLS with the server host at
+// addr, the certificate is checked as mode asks
+func (md *Mailer) dialTLS(addr string, host string, mode string) (*smtp.Client, string, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, md.tlsConfig(host, mode))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	if err := c.Hello(md.Config.Domain); err != nil {
+		c.Close()
+		return nil, "", err
+	}
+
+	return c, describeTLS(conn.ConnectionState(), mode == tlsVerify), nil
+}
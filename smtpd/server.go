@@ -8,7 +8,9 @@ import (
   "net"
   "runtime"
   "strconv"
+  "strings"
   "sync"
+  "sync/atomic"
   "time"
 
   "github.com/fitraditya/surelin-smtpd/config"
@@ -36,6 +38,18 @@ var commands = map[string]bool{
   "STARTTLS": true,
 }
 
+// Mode selects the policy applied on a listener
+type Mode int
+
+const (
+  // SMTP Mode: MX traffic, relaying needs AUTH or a trusted network
+  SMTP Mode = iota
+  // SUBMISSION Mode: message submission (RFC 6409), MAIL needs STARTTLS and AUTH
+  SUBMISSION
+  // SMTPS Mode: submission over implicit TLS (RFC 8314), MAIL needs AUTH
+  SMTPS
+)
+
 type Server struct {
   Store           *data.DataStore
   Mailer          *Mailer
@@ -44,7 +58,9 @@ type Server struct {
   maxIdleSeconds  int
   maxMessageBytes int
   storeMessages   bool
-  listener        net.Listener
+  listeners       []net.Listener
+  mu              sync.Mutex
+  clientId        int64
   shutdown        bool
   waitgroup       *sync.WaitGroup
   timeout         time.Duration
@@ -55,6 +71,9 @@ type Server struct {
   DebugPath       string
   sem             chan int
   SpamRegex       string
+  trustedNets     []*net.IPNet
+  dropUnknown     bool
+  cramMD5         bool
 }
 
 // Init a new Server object
@@ -75,6 +94,9 @@ func NewSmtpServer(cfg config.SmtpConfig, ds *data.DataStore, md *Mailer) *Serve
     DebugPath:        cfg.DebugPath,
     sem:              maxClients,
     SpamRegex:        cfg.SpamRegex,
+    trustedNets:      cfg.TrustedNetworks,
+    dropUnknown:      cfg.DropUnknown,
+    cramMD5:          cfg.CramMD5,
   }
 }
 
@@ -96,32 +118,64 @@ func (s *Server) Start() {
   }
 
   defer s.Stop()
-  addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", cfg.Ip4address, cfg.Ip4port))
+  listener, err := s.listen(cfg.Ip4address, cfg.Ip4port, "SMTP")
 
   if err != nil {
-    log.LogError("Failed to build tcp4 address: %v", err)
     // TODO: More graceful early-shutdown procedure
     s.Stop()
     return
   }
 
+  if cfg.SubmissionIp4port > 0 {
+    if sl, err := s.listen(cfg.SubmissionIp4address, cfg.SubmissionIp4port, "Submission"); err == nil {
+      go s.Serve(sl, SUBMISSION)
+    }
+  }
+
+  if cfg.TLSIp4port > 0 {
+    if s.TLSConfig == nil {
+      log.LogError("SMTPS listener requires a certificate, not starting it")
+    } else if tl, err := s.listen(cfg.TLSIp4address, cfg.TLSIp4port, "SMTPS"); err == nil {
+      go s.Serve(tl, SMTPS)
+    }
+  }
+
+  s.Serve(listener, SMTP)
+}
+
+// listen opens a tcp4 listener for the given address and port
+func (s *Server) listen(ip net.IP, port int, name string) (net.Listener, error) {
+  addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v", ip, port))
+
+  if err != nil {
+    log.LogError("Failed to build tcp4 address: %v", err)
+    return nil, err
+  }
+
   // Start listening for SMTP connections
-  log.LogInfo("SMTP listening on TCP4 %v", addr)
-  s.listener, err = net.ListenTCP("tcp4", addr)
+  log.LogInfo("%s listening on TCP4 %v", name, addr)
+  listener, err := net.ListenTCP("tcp4", addr)
 
   if err != nil {
-    log.LogError("SMTP failed to start tcp4 listener: %v", err)
-    // TODO: More graceful early-shutdown procedure
-    s.Stop()
-    return
+    log.LogError("%s failed to start tcp4 listener: %v", name, err)
+    return nil, err
   }
 
+  return listener, nil
+}
+
+// Serve accepts SMTP connections on an already open listener, the mode
+// selects the policy applied to the sessions
+func (s *Server) Serve(listener net.Listener, mode Mode) {
+  s.mu.Lock()
+  s.listeners = append(s.listeners, listener)
+  s.mu.Unlock()
+
   var tempDelay time.Duration
-  var clientId int64
 
   // Handle incoming connections
-  for clientId = 1; ; clientId++ {
-    if conn, err := s.listener.Accept(); err != nil {
+  for {
+    if conn, err := listener.Accept(); err != nil {
       if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
         // Temporary error, sleep for a bit and try again
         if tempDelay == 0 {
@@ -152,25 +206,41 @@ func (s *Server) Start() {
       log.LogInfo("There are now %s serving goroutines", strconv.Itoa(runtime.NumGoroutine()))
       host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
       s.sem <- 1
-      go s.handleClient(&Client{
+      c := &Client{
         state:      1,
         server:     s,
         conn:       conn,
         remoteHost: host,
         time:       time.Now().Unix(),
-        bufin:      bufio.NewReader(conn),
-        bufout:     bufio.NewWriter(conn),
-        id:         clientId,
-      })
+        id:         atomic.AddInt64(&s.clientId, 1),
+        trusted:    s.isTrustedHost(host),
+        mode:       mode,
+      }
+
+      // Implicit TLS, the handshake happens on the first read or write
+      if mode == SMTPS {
+        c.tlsConn = tls.Server(conn, s.TLSConfig)
+        c.conn = c.tlsConn
+        c.tls_on = true
+      }
+
+      c.bufin = bufio.NewReader(c.conn)
+      c.bufout = bufio.NewWriter(c.conn)
+      go s.handleClient(c)
     }
   }
 }
 
-// Stop requests the SMTP server closes it's listener
+// Stop requests the SMTP server closes it's listeners
 func (s *Server) Stop() {
   log.LogTrace("SMTP shutdown requested, connections will be drained")
   s.shutdown = true
-  s.listener.Close()
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, listener := range s.listeners {
+    listener.Close()
+  }
 }
 
 // Drain causes the caller to block until all active SMTP sessions have finished
@@ -234,6 +304,30 @@ func (s *Server) handleClient(c *Client) {
   c.logInfo("Closing connection")
 }
 
+// isTrustedHost returns true if host is inside one of the trusted networks,
+// which may relay to remote domains without authentication
+func (s *Server) isTrustedHost(host string) bool {
+  ip := net.ParseIP(host)
+
+  if ip == nil {
+    return false
+  }
+
+  for _, network := range s.trustedNets {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// isLocalDomain returns true if mail for domain is delivered locally, that
+// is if it is one of the hosted domains
+func (s *Server) isLocalDomain(domain string) bool {
+  return s.Store.IsLocalDomain(strings.TrimSuffix(domain, "."))
+}
+
 func (s *Server) killClient(c *Client) {
   c.kill_time = time.Now().Unix()
 }
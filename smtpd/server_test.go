@@ -0,0 +1,116 @@
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+// newTestStore returns a memory store hosting example.com with the user
+// alice@example.com, password "secret"
+func newTestStore(t *testing.T) *data.DataStore {
+	ds := &data.DataStore{
+		Storage:      data.CreateMemoryStore(config.DataStoreConfig{}),
+		SaveMailChan: make(chan *config.SMTPMessage, 16),
+	}
+
+	if err := ds.AddDomain("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &data.User{Email: "alice@example.com", Domain: "example.com", IsActive: true}
+	u.SetPassword("secret")
+
+	if err := ds.Storage.StoreUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	return ds
+}
+
+// startTestServer runs Serve on a localhost listener and returns its address
+func startTestServer(t *testing.T, ds *data.DataStore, trusted []*net.IPNet) string {
+	cfg := config.SmtpConfig{
+		Domain:          "mx.example.com",
+		MaxRecipients:   100,
+		MaxClients:      10,
+		MaxIdleSeconds:  30,
+		MaxMessageBytes: 1 << 20,
+		TrustedNetworks: trusted,
+	}
+
+	s := NewSmtpServer(cfg, ds, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Serve(l, SMTP)
+	t.Cleanup(s.Stop)
+	return l.Addr().String()
+}
+
+func TestRelayPolicy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		auth    bool
+		rcpt    string
+		code    int
+	}{
+		{"remote from untrusted client", nil, false, "bob@remote.org", 554},
+		{"hosted domain", nil, false, "alice@example.com", 250},
+		{"remote from trusted network", []*net.IPNet{loopback}, false, "bob@remote.org", 250},
+		{"remote after AUTH", nil, true, "bob@remote.org", 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startTestServer(t, newTestStore(t), tt.trusted)
+			c, err := smtp.Dial(addr)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer c.Close()
+
+			if err := c.Hello("client.example.net"); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.auth {
+				if err := c.Auth(smtp.PlainAuth("", "alice@example.com", "secret", "127.0.0.1")); err != nil {
+					t.Fatalf("AUTH failed: %v", err)
+				}
+			}
+
+			if err := c.Mail("carol@remote.org"); err != nil {
+				t.Fatal(err)
+			}
+
+			code := 250
+
+			if err := c.Rcpt(tt.rcpt); err != nil {
+				e, ok := err.(*textproto.Error)
+
+				if !ok {
+					t.Fatal(err)
+				}
+
+				code = e.Code
+			}
+
+			if code != tt.code {
+				t.Errorf("RCPT TO:<%s> got %d, want %d", tt.rcpt, code, tt.code)
+			}
+		})
+	}
+}
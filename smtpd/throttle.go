@@ -0,0 +1,142 @@
+package smtpd
+
+import (
+	"net/textproto"
+	"regexp"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/log"
+)
+
+const (
+	// How long a batch waits when all the connections to its destination
+	// are busy
+	connectionWait = 10 * time.Second
+
+	// How long a destination is left alone after it said we send too much,
+	// doubled for every such answer in a row
+	busyBackoffMin = time.Minute
+	busyBackoffMax = 30 * time.Minute
+)
+
+// A 451 reply saying the server has too much from us, other 451 are about
+// the message or the recipient
+var busyRegex = regexp.MustCompile(`(?i)too many|connection limit|rate limit|throttl|try again later`)
+
+// destLoad is what the mailer has going on with a destination, counted by
+// the key of its limits
+type destLoad struct {
+	open    int         // Open sessions, idle ones included
+	sent    []time.Time // Transactions started in the last minute
+	blocked time.Time   // No new transaction before
+	backoff time.Duration
+}
+
+// isBusy returns true if err is the remote server refusing us because we
+// send too much or on too many connections
+func isBusy(err error) bool {
+	e, ok := err.(*textproto.Error)
+
+	if !ok {
+		return false
+	}
+
+	return e.Code == 421 || e.Code == 451 && busyRegex.MatchString(e.Msg)
+}
+
+// load returns the load of dest, the pool lock must be held
+func (md *Mailer) load(dest string) *destLoad {
+	if md.loads == nil {
+		md.loads = make(map[string]*destLoad)
+	}
+
+	l := md.loads[dest]
+
+	if l == nil {
+		l = &destLoad{}
+		md.loads[dest] = l
+	}
+
+	return l
+}
+
+// throttle returns how long to wait before a transaction with dest: while it
+// is backed off or while the messages per minute to it are used up. With
+// start set a transaction allowed now is counted.
+func (md *Mailer) throttle(dest string, start bool) time.Duration {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	l := md.load(dest)
+	now := time.Now()
+
+	if wait := l.blocked.Sub(now); wait > 0 {
+		return wait
+	}
+
+	for len(l.sent) > 0 && now.Sub(l.sent[0]) >= time.Minute {
+		l.sent = l.sent[1:]
+	}
+
+	if rate := md.Config.OutboundRate; rate > 0 && len(l.sent) >= rate {
+		return l.sent[len(l.sent)-rate].Add(time.Minute).Sub(now)
+	}
+
+	if start {
+		l.sent = append(l.sent, now)
+	}
+
+	return 0
+}
+
+// openSlot counts a new session with dest, it returns false if the sessions
+// with dest are at the limit
+func (md *Mailer) openSlot(dest string) bool {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	l := md.load(dest)
+
+	if max := md.Config.OutboundMaxConnections; max > 0 && l.open >= max {
+		return false
+	}
+
+	l.open++
+	return true
+}
+
+// closeSlot counts a session with dest less
+func (md *Mailer) closeSlot(dest string) {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	if l := md.load(dest); l.open > 0 {
+		l.open--
+	}
+}
+
+// busy backs off from dest after it said we send too much, for longer each
+// time it says so in a row
+func (md *Mailer) busy(dest string, err error) {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	l := md.load(dest)
+
+	if l.backoff < busyBackoffMin {
+		l.backoff = busyBackoffMin
+	} else if l.backoff *= 2; l.backoff > busyBackoffMax {
+		l.backoff = busyBackoffMax
+	}
+
+	l.blocked = time.Now().Add(l.backoff)
+	log.LogWarn("Destination %s is busy, backing off for %v: %s", dest, l.backoff, diagnostic(err))
+}
+
+// relieve resets the back off of dest once it takes mail again
+func (md *Mailer) relieve(dest string) {
+	md.poolMu.Lock()
+	defer md.poolMu.Unlock()
+
+	md.load(dest).backoff = 0
+}
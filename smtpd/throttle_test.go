@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/fitraditya/surelin-smtpd/data"
+)
+
+func TestIsBusy(t *testing.T) {
+	tests := []struct {
+		err  error
+		busy bool
+	}{
+		{&textproto.Error{Code: 421, Msg: "4.7.0 Service not available"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.7.1 Too many connections from your IP"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Local error in processing"}, false},
+		{&textproto.Error{Code: 550, Msg: "5.7.1 Too many recipients"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if busy := isBusy(tt.err); busy != tt.busy {
+			t.Errorf("isBusy(%v) = %v, want %v", tt.err, busy, tt.busy)
+		}
+	}
+}
+
+func TestLimitsSharedByExchanger(t *testing.T) {
+	fake := startFakeServer(t, "220 fake.example.net ESMTP")
+	md := newTestMailer(t, fake)
+	md.Config.OutboundRate = 1
+
+	// Two domains on the same exchanger, as with big providers
+	md.Resolver = StaticResolver{
+		MX: map[string][]*net.MX{
+			"remote.org": {{Host: "mx.provider.net", Pref: 10}},
+			"remote.net": {{Host: "mx.provider.net", Pref: 10}},
+		},
+		Hosts: map[string][]string{"mx.provider.net": {"127.0.0.1"}},
+	}
+
+	first := data.NewQueuedMessage("alice@example.com", "Subject: 1\r\n\r\nhi\r\n")
+	first.AddRecipient("bob@remote.org", "bob@remote.org")
+	md.attempt(first)
+
+	if first.Recipients[0].Status != data.QueueSent {
+		t.Fatalf("First message is %s, want sent", first.Recipients[0].Status)
+	}
+
+	second := data.NewQueuedMessage("alice@example.com", "Subject: 2\r\n\r\nhi\r\n")
+	second.AddRecipient("carol@remote.net", "carol@remote.net")
+	md.attempt(second)
+
+	if r := second.Recipients[0]; r.Status != data.QueuePending || r.LastError != "" {
+		t.Errorf("Second message is %s (%s), want held back", r.Status, r.LastError)
+	}
+
+	if second.Attempts != 0 {
+		t.Errorf("Held back message counted %d attempts", second.Attempts)
+	}
+
+	if wait := time.Until(second.NextAttempt); wait > time.Minute || wait < 50*time.Second {
+		t.Errorf("Held back message retried in %v, want when the minute is over", wait)
+	}
+}
@@ -0,0 +1,110 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/fitraditya/surelin-smtpd/log"
+)
+
+// Outbound TLS modes, see outbound.tls in the configuration
+const (
+	tlsNone    = "none"
+	tlsMay     = "may"
+	tlsEncrypt = "encrypt"
+	tlsVerify  = "verify"
+)
+
+// tlsPolicy returns the outbound TLS mode for mail to domain
+func (md *Mailer) tlsPolicy(domain string) string {
+	if mode, ok := md.Config.OutboundTLSPolicy[strings.ToLower(domain)]; ok {
+		return mode
+	}
+
+	return md.Config.OutboundTLS
+}
+
+// startTLS upgrades the session c with the server host as mode asks. It
+// returns the negotiated TLS parameters, or "" if the session stays in
+// plaintext. Modes other than may fail if the server does not offer
+// STARTTLS, verify also fails if its certificate does not match the host.
+func (md *Mailer) startTLS(c *smtp.Client, host string, mode string) (string, error) {
+	if mode == tlsNone {
+		return "", nil
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if mode == tlsMay {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("TLS required by policy, %s does not offer STARTTLS", host)
+	}
+
+	if err := c.StartTLS(md.tlsConfig(host, mode)); err != nil {
+		return "", fmt.Errorf("STARTTLS with %s failed: %s", host, err)
+	}
+
+	state, _ := c.TLSConnectionState()
+	return describeTLS(state, mode == tlsVerify), nil
+}
+
+// upgrade runs startTLS on the session c with the server host at addr. If
+// opportunistic TLS fails it goes on in plaintext on a new session, as the
+// failed handshake left c unusable. On errors c is closed.
+func (md *Mailer) upgrade(c *smtp.Client, addr string, host string, mode string) (*smtp.Client, string, error) {
+	tlsInfo, err := md.startTLS(c, host, mode)
+
+	if err == nil {
+		return c, tlsInfo, nil
+	}
+
+	c.Close()
+
+	if mode != tlsMay {
+		return nil, "", err
+	}
+
+	log.LogWarn("%s, sending in plaintext", err)
+	c, err = dial(addr, host, md.Config.Domain)
+	return c, "", err
+}
+
+// tlsConfig returns the TLS client configuration for host, its certificate
+// is only checked in verify mode
+func (md *Mailer) tlsConfig(host string, mode string) *tls.Config {
+	return &tls.Config{
+		ServerName:         host,
+		MinVersion:         md.Config.OutboundTLSMinVersion,
+		InsecureSkipVerify: mode != tlsVerify,
+	}
+}
+
+// describeTLS returns the version and cipher suite of a TLS session and if
+// the certificate of the server was verified
+func describeTLS(state tls.ConnectionState, verified bool) string {
+	trust := "unverified"
+
+	if verified {
+		trust = "verified"
+	}
+
+	return fmt.Sprintf("%s %s, %s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), trust)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+
+	return fmt.Sprintf("TLS 0x%04x", version)
+}
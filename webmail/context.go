@@ -7,7 +7,6 @@ import (
 	"github.com/fitraditya/surelin-smtpd/data"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type Context struct {
@@ -17,7 +16,7 @@ type Context struct {
 	IsJson    bool
 	User      *data.User
 	ClientIp  string
-	Ds        *data.MongoDB
+	Ds        data.Storage
 }
 
 func (c *Context) Close() {
@@ -50,7 +49,7 @@ func NewContext(req *http.Request) (*Context, error) {
 		DataStore: DataStore,
 		ClientIp:  parseRemoteAddr(req),
 		IsJson:    headerMatch(req, "Accept", "application/json"),
-		Ds:        DataStore.Storage.(*data.MongoDB),
+		Ds:        DataStore.Storage,
 	}
 
 	if err != nil {
@@ -59,16 +58,11 @@ func NewContext(req *http.Request) (*Context, error) {
 
 	// Try to fill in the user from the session
 	if user, ok := sess.Values["user"].(string); ok {
-		if bson.IsObjectIdHex(user) {
-			uid := bson.ObjectIdHex(user)
-			err := ctx.Ds.Users.Find(bson.M{"_id": uid}).One(&ctx.User)
+		ctx.User, err = ctx.Ds.LoadUser(user)
 
-			if err != nil {
-				ctx.User = nil
-				return ctx, nil
-			}
-		} else {
+		if err != nil {
 			ctx.User = nil
+			return ctx, nil
 		}
 	}
 
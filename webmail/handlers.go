@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fitraditya/surelin-smtpd/config"
@@ -30,10 +31,11 @@ func MailAttachment(w http.ResponseWriter, r *http.Request, ctx *Context) (err e
 		return LoginForm(w, r, ctx)
 	}
 
-	m, err := ctx.Ds.LoadAttachment(id)
+	m, err := ctx.Ds.LoadAttachment(ctx.User.Email, id)
 
 	if err != nil {
-		return fmt.Errorf("ID provided is invalid: %v", err)
+		http.NotFound(w, r)
+		return nil
 	}
 
 	if len(m.Attachments) > 0 {
@@ -55,6 +57,30 @@ func MailAttachment(w http.ResponseWriter, r *http.Request, ctx *Context) (err e
 	}
 }
 
+func MailRaw(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	id := ctx.Vars["id"]
+	log.LogTrace("Loading raw Mail <%s>", id)
+
+	// We need a user to sign to
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	m, err := ctx.Ds.Load(id)
+
+	if err != nil || !m.IsDeliveredTo(ctx.User.Email) {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+m.Id+".eml\"")
+	http.ServeContent(w, r, m.Id+".eml", m.Created, strings.NewReader(m.RawMessage()))
+	return nil
+}
+
 func MailDelete(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
 	id := ctx.Vars["id"]
 	log.LogTrace("Delete Mail <%s> from Mongodb", id)
@@ -66,6 +92,12 @@ func MailDelete(w http.ResponseWriter, r *http.Request, ctx *Context) (err error
 		return LoginForm(w, r, ctx)
 	}
 
+	// Only messages delivered to the user can be deleted
+	if m, err := ctx.Ds.Load(id); err != nil || !m.IsDeliveredTo(ctx.User.Email) {
+		http.NotFound(w, r)
+		return nil
+	}
+
 	err = ctx.Ds.DeleteOne(id)
 
 	if err == nil {
@@ -93,11 +125,8 @@ func MailView(w http.ResponseWriter, r *http.Request, ctx *Context) (err error)
 
 	m, err := ctx.Ds.Load(id)
 
-	if err == nil {
-		ctx.Ds.Messages.Update(
-			bson.M{"id": m.Id},
-			bson.M{"$set": bson.M{"unread": false}},
-		)
+	if err == nil && m.IsDeliveredTo(ctx.User.Email) {
+		ctx.Ds.SetUnread(m.Id, false)
 		return RenderTemplate("mailbox/_show.html", w, map[string]interface{}{
 			"ctx":     ctx,
 			"title":   "Mail",
@@ -105,7 +134,7 @@ func MailView(w http.ResponseWriter, r *http.Request, ctx *Context) (err error)
 		})
 	} else {
 		http.NotFound(w, r)
-		return
+		return nil
 	}
 }
 
@@ -121,7 +150,7 @@ func MailList(w http.ResponseWriter, r *http.Request, ctx *Context) (err error)
 		return LoginForm(w, r, ctx)
 	}
 
-	t, err := ctx.Ds.Total()
+	t, err := ctx.Ds.Total(ctx.User.Email)
 
 	if err != nil {
 		http.NotFound(w, r)
@@ -135,7 +164,7 @@ func MailList(w http.ResponseWriter, r *http.Request, ctx *Context) (err error)
 		return
 	}
 
-	messages, err := ctx.Ds.List(p.Offset(), p.Limit())
+	messages, err := ctx.Ds.List(ctx.User.Email, p.Offset(), p.Limit())
 
 	if err == nil {
 		return RenderTemplate("mailbox/_list.html", w, map[string]interface{}{
@@ -151,6 +180,195 @@ func MailList(w http.ResponseWriter, r *http.Request, ctx *Context) (err error)
 	}
 }
 
+func DomainList(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	// We need a user to sign to
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	// Domains are managed by superusers only
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	domains, err := ctx.Ds.ListDomains()
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	return RenderTemplate("admin/domains.html", w, map[string]interface{}{
+		"ctx":     ctx,
+		"title":   "Domains",
+		"domains": domains,
+	})
+}
+
+func DomainAdd(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := r.FormValue("name")
+
+	if err := ctx.DataStore.AddDomain(name); err != nil {
+		log.LogError("Failed to add domain %q: %v", name, err)
+		ctx.Session.AddFlash("Problem adding domain " + name)
+	} else {
+		ctx.Session.AddFlash("Successfuly added domain " + name)
+	}
+
+	http.Redirect(w, r, reverse("Domains"), http.StatusSeeOther)
+	return nil
+}
+
+func DomainDelete(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	name := ctx.Vars["name"]
+	log.LogTrace("Delete domain <%s>", name)
+
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err = ctx.DataStore.DeleteDomain(name); err != nil {
+		http.NotFound(w, r)
+		return err
+	}
+
+	ctx.Session.AddFlash("Successfuly deleted domain " + name)
+	http.Redirect(w, r, reverse("Domains"), http.StatusSeeOther)
+	return nil
+}
+
+// DomainPlus switches plus addressing of a domain on or off, as the "plus"
+// form value says
+func DomainPlus(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	name := ctx.Vars["name"]
+
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = ctx.DataStore.SetPlusAddressing(name, r.FormValue("plus") == "on")
+
+	if err == data.ErrNotFound {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, reverse("Domains"), http.StatusSeeOther)
+	return nil
+}
+
+func AliasList(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	// Aliases are managed by superusers only
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	aliases, err := ctx.Ds.ListAliases()
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	return RenderTemplate("admin/aliases.html", w, map[string]interface{}{
+		"ctx":     ctx,
+		"title":   "Aliases",
+		"aliases": aliases,
+	})
+}
+
+func AliasAdd(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	address := r.FormValue("address")
+	targets := strings.FieldsFunc(r.FormValue("targets"), func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r'
+	})
+
+	if err := ctx.DataStore.AddAlias(address, targets); err != nil {
+		log.LogError("Failed to add alias %q: %v", address, err)
+		ctx.Session.AddFlash(fmt.Sprintf("Problem adding alias: %v", err))
+	} else {
+		ctx.Session.AddFlash("Successfuly added alias " + address)
+	}
+
+	http.Redirect(w, r, reverse("Aliases"), http.StatusSeeOther)
+	return nil
+}
+
+func AliasDelete(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
+	address := ctx.Vars["address"]
+	log.LogTrace("Delete alias <%s>", address)
+
+	if ctx.User == nil {
+		log.LogTrace("This page requires a login")
+		ctx.Session.AddFlash("This page requires a login")
+		return LoginForm(w, r, ctx)
+	}
+
+	if !ctx.User.IsSuperuser {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err = ctx.DataStore.DeleteAlias(address); err != nil {
+		http.NotFound(w, r)
+		return err
+	}
+
+	ctx.Session.AddFlash("Successfuly deleted alias " + address)
+	http.Redirect(w, r, reverse("Aliases"), http.StatusSeeOther)
+	return nil
+}
+
 func Home(w http.ResponseWriter, r *http.Request, ctx *Context) (err error) {
 	greeting, err := ioutil.ReadFile(config.GetWebConfig().GreetingFile)
 
@@ -183,10 +401,10 @@ func Login(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 
 		if err == nil {
 			log.LogTrace("Login successful for session <%v>", u.Id)
-			ctx.Ds.Users.Update(
-				bson.M{"_id": u.Id},
-				bson.M{"$set": bson.M{"lastlogintime": time.Now(), "lastloginip": ctx.ClientIp}, "$inc": bson.M{"logincount": 1}},
-			)
+			u.LastLoginTime = time.Now()
+			u.LastLoginIp = ctx.ClientIp
+			u.LoginCount++
+			ctx.Ds.UpdateUser(u)
 
 			if u.IsActive {
 				ctx.Session.Values["user"] = u.Id.Hex()
@@ -222,8 +440,19 @@ func RegisterForm(w http.ResponseWriter, req *http.Request, ctx *Context) (err e
 		http.Redirect(w, req, reverse("Mails"), http.StatusSeeOther)
 	}
 
+	// Offer the domains open for sign up
+	domains := []data.Domain{}
+	all, _ := ctx.Ds.ListDomains()
+
+	for _, d := range all {
+		if d.IsActive {
+			domains = append(domains, d)
+		}
+	}
+
 	return RenderTemplate("common/signup.html", w, map[string]interface{}{
-		"ctx": ctx,
+		"ctx":     ctx,
+		"domains": domains,
 	})
 }
 
@@ -239,26 +468,30 @@ func Register(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	}
 
 	if r.Validate() {
-		result := &data.User{}
-		err := ctx.Ds.Users.Find(bson.M{"email": r.Email}).One(&result)
-
-		if err == nil {
+		if _, err := ctx.Ds.IsUserExists(r.Email); err == nil {
 			ctx.Session.AddFlash("User already exists!")
 			return RegisterForm(w, req, ctx)
 		}
 
+		// Users belong to one of the hosted domains
+		if !ctx.DataStore.IsLocalDomain(data.DomainOf(r.Email)) {
+			ctx.Session.AddFlash("Sign up is only open to addresses of hosted domains!")
+			return RegisterForm(w, req, ctx)
+		}
+
 		u := &data.User{
 			Id:          bson.NewObjectId(),
 			Firstname:   req.FormValue("firstname"),
 			Lastname:    req.FormValue("lastname"),
 			Email:       req.FormValue("email"),
+			Domain:      data.DomainOf(r.Email),
 			IsActive:    true,
 			JoinedAt:    time.Now(),
 			LastLoginIp: ctx.ClientIp,
 		}
 		u.SetPassword(r.Password)
 
-		if err := ctx.Ds.Users.Insert(u); err != nil {
+		if err := ctx.Ds.StoreUser(u); err != nil {
 			ctx.Session.AddFlash("Problem registering user.")
 			return RegisterForm(w, req, ctx)
 		}
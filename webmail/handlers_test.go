@@ -0,0 +1,164 @@
+package webmail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fitraditya/surelin-smtpd/config"
+	"github.com/fitraditya/surelin-smtpd/data"
+	"github.com/gorilla/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A message with one attachment
+const testRaw = "From: carol@remote.org\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Contract\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"note.txt\"\r\n" +
+	"\r\n" +
+	"Attached\r\n" +
+	"--b1--\r\n"
+
+func TestMailOfAnotherUser(t *testing.T) {
+	ds := data.CreateMemoryStore(config.DataStoreConfig{})
+	alice := &data.User{Id: bson.NewObjectId(), Email: "alice@example.com", IsActive: true}
+	bob := &data.User{Id: bson.NewObjectId(), Email: "bob@example.com", IsActive: true}
+
+	m := data.ParseRawMessage(bson.NewObjectId().Hex(), testRaw)
+	m.To = []*data.Path{data.PathFromString(alice.Email)}
+
+	if _, err := ds.Store(m); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := ds.Fetch(alice.Email)
+
+	if err != nil || len(*messages) != 1 || len((*messages)[0].Attachments) != 1 {
+		t.Fatalf("Fetch returned %v, %v", messages, err)
+	}
+
+	id := (*messages)[0].Id
+	attachment := (*messages)[0].Attachments[0].Id
+
+	tests := []struct {
+		name    string
+		handler handler
+		id      string
+	}{
+		{"MailView", MailView, id},
+		{"MailRaw", MailRaw, id},
+		{"MailDelete", MailDelete, id},
+		{"MailAttachment", MailAttachment, attachment},
+		{"MailRaw unknown id", MailRaw, bson.NewObjectId().Hex()},
+		{"MailView unknown id", MailView, bson.NewObjectId().Hex()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &Context{Vars: map[string]string{"id": tt.id}, User: bob, Ds: ds}
+			w := httptest.NewRecorder()
+
+			if err := tt.handler(w, httptest.NewRequest("GET", "/", nil), ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s returned %d, want 404", tt.name, w.Code)
+			}
+		})
+	}
+
+	if n, _ := ds.Total(alice.Email); n != 1 {
+		t.Errorf("Message of the owner gone after MailDelete by another user")
+	}
+
+	// The owner gets it
+	ctx := &Context{Vars: map[string]string{"id": id}, User: alice, Ds: ds}
+	w := httptest.NewRecorder()
+
+	if err := MailRaw(w, httptest.NewRequest("GET", "/", nil), ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK {
+		t.Errorf("MailRaw for the owner returned %d, want 200", w.Code)
+	}
+}
+
+func TestDomainAdmin(t *testing.T) {
+	ds := &data.DataStore{Storage: data.CreateMemoryStore(config.DataStoreConfig{})}
+
+	if err := ds.AddDomain("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.AddAlias("info@example.com", []string{"alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	setupRoutes(config.WebConfig{})
+
+	// State is changed over POST only
+	for _, path := range []string{"/domain/plus/example.com", "/domain/delete/example.com", "/alias/delete/info@example.com"} {
+		w := httptest.NewRecorder()
+		Router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s returned %d, want 405", path, w.Code)
+		}
+	}
+
+	admin := &data.User{Id: bson.NewObjectId(), Email: "alice@example.com", IsActive: true, IsSuperuser: true}
+	post := func(h handler, vars map[string]string, form url.Values) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := &Context{Vars: vars, User: admin, DataStore: ds, Ds: ds.Storage, Session: sessions.NewSession(sessions.NewCookieStore([]byte("test")), "test")}
+		w := httptest.NewRecorder()
+
+		if err := h(w, r, ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code
+	}
+
+	if code := post(DomainPlus, map[string]string{"name": "example.com"}, url.Values{"plus": {"off"}}); code != http.StatusSeeOther {
+		t.Errorf("DomainPlus returned %d, want 303", code)
+	}
+
+	if d, _ := ds.Storage.LoadDomain("example.com"); d.PlusAddressing {
+		t.Error("Plus addressing still on")
+	}
+
+	if code := post(DomainPlus, map[string]string{"name": "remote.org"}, url.Values{"plus": {"on"}}); code != http.StatusNotFound {
+		t.Errorf("DomainPlus for a domain not hosted returned %d, want 404", code)
+	}
+
+	if code := post(AliasDelete, map[string]string{"address": "Info@Example.com"}, nil); code != http.StatusSeeOther {
+		t.Errorf("AliasDelete returned %d, want 303", code)
+	}
+
+	if _, err := ds.Storage.LoadAlias("info@example.com"); err == nil {
+		t.Error("Alias still stored after AliasDelete")
+	}
+
+	if code := post(DomainDelete, map[string]string{"name": "example.com"}, nil); code != http.StatusSeeOther {
+		t.Errorf("DomainDelete returned %d, want 303", code)
+	}
+
+	if ds.IsLocalDomain("example.com") {
+		t.Error("Domain still hosted after DomainDelete")
+	}
+}
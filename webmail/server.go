@@ -69,8 +69,20 @@ func setupRoutes(cfg config.WebConfig) {
 	r.Path("/mails/{page:[0-9]+}").Handler(handler(MailList)).Name("MailList").Methods("GET")
 	r.Path("/mail/{id:[0-9a-z]+}").Handler(handler(MailView)).Name("MailView").Methods("GET")
 	r.Path("/mail/attachment/{id:[0-9a-z]+}/{[*.*]}").Handler(handler(MailAttachment)).Name("MailAttachment").Methods("GET")
+	r.Path("/mail/raw/{id:[0-9a-z]+}").Handler(handler(MailRaw)).Name("MailRaw").Methods("GET")
 	r.Path("/mail/delete/{id:[0-9a-z]+}").Handler(handler(MailDelete)).Name("MailDelete").Methods("GET")
 
+	// Hosted domains
+	r.Path("/domains").Handler(handler(DomainList)).Name("Domains").Methods("GET")
+	r.Path("/domains").Handler(handler(DomainAdd)).Methods("POST")
+	r.Path("/domain/delete/{name:[0-9a-z.-]+}").Handler(handler(DomainDelete)).Name("DomainDelete").Methods("POST")
+	r.Path("/domain/plus/{name:[0-9a-z.-]+}").Handler(handler(DomainPlus)).Name("DomainPlus").Methods("POST")
+
+	// Aliases
+	r.Path("/aliases").Handler(handler(AliasList)).Name("Aliases").Methods("GET")
+	r.Path("/aliases").Handler(handler(AliasAdd)).Methods("POST")
+	r.Path("/alias/delete/{address}").Handler(handler(AliasDelete)).Name("AliasDelete").Methods("POST")
+
 	// Login
 	r.Path("/login").Handler(handler(Login)).Methods("POST")
 	r.Path("/login").Handler(handler(LoginForm)).Name("Login").Methods("GET")